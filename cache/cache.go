@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -8,27 +10,78 @@ import (
 	"time"
 
 	"github.com/gobwas/glob"
-	lru "github.com/hashicorp/golang-lru/v2/expirable"
+	lru "github.com/hashicorp/golang-lru/v2"
 )
 
 const (
+	// IPResolutionTTL is how long addresses are cached when the resolver
+	// reports no TTL, as the system resolver does.
 	IPResolutionTTL = 5 * time.Minute
+
+	DefaultMinTTL      = 30 * time.Second
+	DefaultMaxTTL      = time.Hour
+	DefaultNegativeTTL = 30 * time.Second
+
+	// prefetchFraction is the part of its TTL an address has left when a use
+	// refreshes it in the background: a tenth.
+	prefetchFraction = 10
 )
 
+// Resolver looks up the addresses of hostnames for ResolveHost, together
+// with how long they may be cached, or 0 when unknown.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// dnsEntry is a cached lookup result: addresses, or the error of a failed
+// lookup for negative caching.
+type dnsEntry struct {
+	ips     []net.IP
+	err     error
+	ttl     time.Duration
+	expires time.Time
+}
+
+// lookupCall is a lookup in flight, shared by everyone resolving its name.
+// It is cancelled once none of them waits for it anymore.
+type lookupCall struct {
+	done    chan struct{}
+	entry   dnsEntry
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
 type CacheManager struct {
-	globCache map[string]glob.Glob
-	cidrCache map[string]*net.IPNet
-	dnsCache  *lru.LRU[string, []net.IP]
-	mu        sync.RWMutex
+	globCache   map[string]glob.Glob
+	cidrCache   map[string]*net.IPNet
+	dnsCache    *lru.Cache[string, dnsEntry]
+	resolver    Resolver
+	staticHosts map[string][]net.IP
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	generation  uint64 // incremented by ClearDNSCache
+	mu          sync.RWMutex
+
+	lookups  map[string]*lookupCall
+	lookupMu sync.Mutex
+
+	fakeIPs  *fakeIPPool
+	fakeIPMu sync.Mutex
 }
 
 func NewCacheManager() *CacheManager {
-	dnsCache := lru.NewLRU[string, []net.IP](1000, nil, IPResolutionTTL)
+	dnsCache, _ := lru.New[string, dnsEntry](1000)
 
 	return &CacheManager{
-		globCache: make(map[string]glob.Glob),
-		cidrCache: make(map[string]*net.IPNet),
-		dnsCache:  dnsCache,
+		globCache:   make(map[string]glob.Glob),
+		cidrCache:   make(map[string]*net.IPNet),
+		dnsCache:    dnsCache,
+		minTTL:      DefaultMinTTL,
+		maxTTL:      DefaultMaxTTL,
+		negativeTTL: DefaultNegativeTTL,
+		lookups:     make(map[string]*lookupCall),
 	}
 }
 
@@ -85,19 +138,296 @@ func (c *CacheManager) GetCIDRNet(cidr string) (*net.IPNet, error) {
 	return ipNet, nil
 }
 
+// SetResolver makes ResolveHost use resolver, or the system resolver when
+// nil. Cached addresses are kept, see ClearDNSCache.
+func (c *CacheManager) SetResolver(resolver Resolver) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resolver = resolver
+}
+
+// HasResolver reports whether a resolver replaces the system one.
+func (c *CacheManager) HasResolver() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.resolver != nil
+}
+
+// SetDNSTTLs bounds how long resolved addresses are cached, and sets how
+// long failed lookups are remembered at most.
+func (c *CacheManager) SetDNSTTLs(minTTL, maxTTL, negativeTTL time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.minTTL = minTTL
+	c.maxTTL = maxTTL
+	c.negativeTTL = negativeTTL
+}
+
+func (c *CacheManager) ClearDNSCache() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.dnsCache.Purge()
+}
+
+// SetStaticHosts pins hostnames to addresses, ahead of DNS. Keys are
+// lowercase names or *.domain patterns, matching domain and every name below
+// it; the most specific entry wins.
+func (c *CacheManager) SetStaticHosts(hosts map[string][]net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.staticHosts = hosts
+}
+
+// HasStaticHosts reports whether any hostname is pinned.
+func (c *CacheManager) HasStaticHosts() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.staticHosts) > 0
+}
+
+// StaticHost returns the addresses hostname is pinned to, if any.
+func (c *CacheManager) StaticHost(hostname string) ([]net.IP, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.staticHosts) == 0 {
+		return nil, false
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if ips, exists := c.staticHosts[name]; exists {
+		return ips, true
+	}
+	for {
+		if ips, exists := c.staticHosts["*."+name]; exists {
+			return ips, true
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return nil, false
+		}
+		name = parent
+	}
+}
+
 func (c *CacheManager) ResolveHost(hostname string) ([]net.IP, error) {
-	if ips, exists := c.dnsCache.Get(hostname); exists {
+	return c.ResolveHostContext(context.Background(), hostname)
+}
+
+// ResolveHostContext is ResolveHost giving up once ctx is done.
+func (c *CacheManager) ResolveHostContext(ctx context.Context, hostname string) ([]net.IP, error) {
+	if ips, pinned := c.StaticHost(hostname); pinned {
+		return ips, nil
+	}
+
+	entry := c.resolve(ctx, hostname)
+	return entry.ips, entry.err
+}
+
+// DNSExpiry returns when the cached lookup of hostname expires, and false
+// when there is none.
+func (c *CacheManager) DNSExpiry(hostname string) (time.Time, bool) {
+	entry, exists := c.dnsCache.Peek(hostname)
+	if !exists || !time.Now().Before(entry.expires) {
+		return time.Time{}, false
+	}
+	return entry.expires, true
+}
+
+// RefreshHost looks hostname up anew and caches the result, sharing a lookup
+// of the name already in flight.
+func (c *CacheManager) RefreshHost(hostname string) ([]net.IP, error) {
+	if ips, pinned := c.StaticHost(hostname); pinned {
 		return ips, nil
 	}
 
-	ips, err := net.LookupIP(hostname)
+	entry := c.lookup(context.Background(), hostname)
+	return entry.ips, entry.err
+}
+
+// resolve returns the cached lookup of hostname, or looks it up. Addresses
+// used shortly before they expire are refreshed in the background, so that
+// hosts in use never wait for a lookup.
+func (c *CacheManager) resolve(ctx context.Context, hostname string) dnsEntry {
+	if entry, exists := c.dnsCache.Get(hostname); exists {
+		remaining := time.Until(entry.expires)
+		if remaining > 0 {
+			if entry.err == nil && remaining < entry.ttl/prefetchFraction {
+				c.prefetch(hostname)
+			}
+			return entry
+		}
+	}
+
+	return c.lookup(ctx, hostname)
+}
+
+// lookup resolves hostname, or waits for the lookup already in flight,
+// until ctx is done.
+func (c *CacheManager) lookup(ctx context.Context, hostname string) dnsEntry {
+	call, started := c.startLookup(ctx, hostname)
+	if started {
+		go c.finishLookup(hostname, call)
+	}
+
+	select {
+	case <-call.done:
+		return call.entry
+	case <-ctx.Done():
+		c.leaveLookup(hostname, call)
+		return dnsEntry{err: ctx.Err()}
+	}
+}
+
+// prefetch starts a background lookup of hostname unless one is in flight.
+// Nobody leaves it, so it is never cancelled.
+func (c *CacheManager) prefetch(hostname string) {
+	if call, started := c.startLookup(context.Background(), hostname); started {
+		go c.finishLookup(hostname, call)
+	}
+}
+
+// startLookup joins the lookup of hostname in flight, or starts one with the
+// values but not the cancellation of ctx, as other callers may join it.
+func (c *CacheManager) startLookup(ctx context.Context, hostname string) (*lookupCall, bool) {
+	c.lookupMu.Lock()
+	defer c.lookupMu.Unlock()
+
+	if call, exists := c.lookups[hostname]; exists {
+		call.waiters++
+		return call, false
+	}
+	lookupCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	call := &lookupCall{done: make(chan struct{}), ctx: lookupCtx, cancel: cancel, waiters: 1}
+	c.lookups[hostname] = call
+	return call, true
+}
+
+// leaveLookup stops waiting for call, cancelling it when it was the last
+// one waiting.
+func (c *CacheManager) leaveLookup(hostname string, call *lookupCall) {
+	c.lookupMu.Lock()
+	defer c.lookupMu.Unlock()
+
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	if c.lookups[hostname] == call {
+		delete(c.lookups, hostname)
+	}
+	call.cancel()
+}
+
+func (c *CacheManager) finishLookup(hostname string, call *lookupCall) {
+	call.entry = c.query(call.ctx, hostname)
+
+	c.lookupMu.Lock()
+	if c.lookups[hostname] == call {
+		delete(c.lookups, hostname)
+	}
+	c.lookupMu.Unlock()
+
+	call.cancel()
+	close(call.done)
+}
+
+// query asks the resolver for the addresses of hostname and caches the
+// answer for its TTL.
+func (c *CacheManager) query(ctx context.Context, hostname string) dnsEntry {
+	c.mu.RLock()
+	resolver := c.resolver
+	minTTL, maxTTL, negativeTTL := c.minTTL, c.maxTTL, c.negativeTTL
+	generation := c.generation
+	c.mu.RUnlock()
+
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if resolver != nil {
+		ips, ttl, err = resolver.LookupIP(ctx, hostname)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", hostname)
+	}
+
 	if err != nil {
-		return nil, err
+		// NXDOMAIN and SERVFAIL answers are cached too, lookups that got no
+		// answer are not.
+		if !isNegativeAnswer(err) {
+			return dnsEntry{err: err}
+		}
+		if ttl <= 0 || ttl > negativeTTL {
+			ttl = negativeTTL
+		}
+	} else {
+		if ttl <= 0 {
+			ttl = IPResolutionTTL
+		}
+		ttl = min(max(ttl, minTTL), maxTTL)
+	}
+
+	entry := dnsEntry{ips: ips, err: err, ttl: ttl, expires: time.Now().Add(ttl)}
+
+	// Answers of the resolvers replaced by a reload are not cached.
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.generation == generation {
+		c.dnsCache.Add(hostname, entry)
 	}
+	return entry
+}
+
+// isNegativeAnswer reports whether err is an answer of a DNS server that the
+// name does not exist or that the server failed, rather than a query that
+// timed out or could not be sent.
+func isNegativeAnswer(err error) bool {
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsTimeout {
+		return false
+	}
+	return dnsErr.IsNotFound || strings.HasPrefix(dnsErr.Err, "server misbehaving")
+}
 
-	c.dnsCache.Add(hostname, ips)
+// DNSRecord is a cached address lookup, as saved across restarts.
+type DNSRecord struct {
+	Host    string        `json:"host"`
+	IPs     []net.IP      `json:"ips"`
+	TTL     time.Duration `json:"ttl"`
+	Expires time.Time     `json:"expires"`
+}
 
-	return ips, nil
+// DNSRecords returns the unexpired addresses in the DNS cache, least
+// recently used first. Failed lookups are left out.
+func (c *CacheManager) DNSRecords() []DNSRecord {
+	now := time.Now()
+	var records []DNSRecord
+	for _, host := range c.dnsCache.Keys() {
+		entry, exists := c.dnsCache.Peek(host)
+		if !exists || entry.err != nil || !now.Before(entry.expires) {
+			continue
+		}
+		records = append(records, DNSRecord{Host: host, IPs: entry.ips, TTL: entry.ttl, Expires: entry.expires})
+	}
+	return records
+}
+
+// RestoreDNSRecords adds the unexpired records to the DNS cache.
+func (c *CacheManager) RestoreDNSRecords(records []DNSRecord) {
+	now := time.Now()
+	for _, record := range records {
+		if len(record.IPs) == 0 || !now.Before(record.Expires) {
+			continue
+		}
+		c.dnsCache.Add(record.Host, dnsEntry{ips: record.IPs, ttl: record.TTL, expires: record.Expires})
+	}
 }
 
 func (c *CacheManager) PrecompilePatterns(hostPatterns, urlPatterns, ipPatterns []string) {
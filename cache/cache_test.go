@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers every lookup with the same result and counts them.
+type fakeResolver struct {
+	mu    sync.Mutex
+	calls int
+	ips   []net.IP
+	ttl   time.Duration
+	err   error
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls++
+	return r.ips, r.ttl, r.err
+}
+
+func (r *fakeResolver) callCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.calls
+}
+
+func newTestCache(resolver Resolver) *CacheManager {
+	c := NewCacheManager()
+	c.SetResolver(resolver)
+	return c
+}
+
+// expiresIn returns how long the cached lookup of host has left.
+func expiresIn(t *testing.T, c *CacheManager, host string) time.Duration {
+	t.Helper()
+
+	expires, ok := c.DNSExpiry(host)
+	if !ok {
+		t.Fatalf("no cached lookup of %s", host)
+	}
+	return time.Until(expires)
+}
+
+func TestResolveHostClampsTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{"below minimum", time.Second, DefaultMinTTL},
+		{"within bounds", 10 * time.Minute, 10 * time.Minute},
+		{"above maximum", 10 * time.Hour, DefaultMaxTTL},
+		{"unknown", 0, IPResolutionTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &fakeResolver{ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: tt.ttl}
+			c := newTestCache(resolver)
+
+			ips, err := c.ResolveHost("example.com")
+			if err != nil || len(ips) != 1 {
+				t.Fatalf("ResolveHost() = %v, %v", ips, err)
+			}
+
+			remaining := expiresIn(t, c, "example.com")
+			if remaining > tt.want || remaining < tt.want-time.Second {
+				t.Errorf("cached for %v, want %v", remaining, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveHostUsesCache(t *testing.T) {
+	resolver := &fakeResolver{ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Hour}
+	c := newTestCache(resolver)
+
+	for range 3 {
+		if _, err := c.ResolveHost("example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := resolver.callCount(); calls != 1 {
+		t.Errorf("resolver called %d times, want 1", calls)
+	}
+
+	c.ClearDNSCache()
+	if _, err := c.ResolveHost("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := resolver.callCount(); calls != 2 {
+		t.Errorf("resolver called %d times after ClearDNSCache, want 2", calls)
+	}
+}
+
+func TestResolveHostCachesNegativeAnswers(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		err  error
+		want time.Duration
+	}{
+		{"nxdomain with SOA TTL", 5 * time.Second, &net.DNSError{Err: "no such host", IsNotFound: true}, 5 * time.Second},
+		{"nxdomain above negativeTTL", time.Hour, &net.DNSError{Err: "no such host", IsNotFound: true}, DefaultNegativeTTL},
+		{"nxdomain without SOA", 0, &net.DNSError{Err: "no such host", IsNotFound: true}, DefaultNegativeTTL},
+		{"servfail", 0, &net.DNSError{Err: "server misbehaving: RCodeServerFailure", IsTemporary: true}, DefaultNegativeTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &fakeResolver{ttl: tt.ttl, err: tt.err}
+			c := newTestCache(resolver)
+
+			for range 2 {
+				if _, err := c.ResolveHost("missing.example"); err == nil {
+					t.Fatal("ResolveHost() succeeded, want error")
+				}
+			}
+			if calls := resolver.callCount(); calls != 1 {
+				t.Errorf("resolver called %d times, want 1", calls)
+			}
+
+			remaining := expiresIn(t, c, "missing.example")
+			if remaining > tt.want || remaining < tt.want-time.Second {
+				t.Errorf("cached for %v, want %v", remaining, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveHostSkipsFailedQueries(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"transport error", errors.New("error querying DNS for example.com: connection refused")},
+		{"timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true, IsTemporary: true}},
+		{"system resolver dial error", &net.DNSError{Err: "dial udp: network is unreachable", IsTemporary: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &fakeResolver{err: tt.err}
+			c := newTestCache(resolver)
+
+			for range 2 {
+				if _, err := c.ResolveHost("example.com"); err == nil {
+					t.Fatal("ResolveHost() succeeded, want error")
+				}
+			}
+			if calls := resolver.callCount(); calls != 2 {
+				t.Errorf("resolver called %d times, want 2", calls)
+			}
+			if _, ok := c.DNSExpiry("example.com"); ok {
+				t.Error("failed query was cached")
+			}
+		})
+	}
+}
+
+func TestSetDNSTTLs(t *testing.T) {
+	resolver := &fakeResolver{ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Second}
+	c := newTestCache(resolver)
+	c.SetDNSTTLs(2*time.Minute, 3*time.Minute, time.Minute)
+
+	if _, err := c.ResolveHost("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if remaining := expiresIn(t, c, "example.com"); remaining < 2*time.Minute-time.Second || remaining > 2*time.Minute {
+		t.Errorf("cached for %v, want 2m", remaining)
+	}
+}
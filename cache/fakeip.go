@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+// FakeIPRecord is a name and the fake IP it was handed out, as saved across
+// restarts.
+type FakeIPRecord struct {
+	Host string `json:"host"`
+	IP   net.IP `json:"ip"`
+}
+
+// fakeIPPool hands out the addresses of an IPv4 network, one per name. When
+// it is full, the address of the least recently used name is reassigned.
+type fakeIPPool struct {
+	network  *net.IPNet
+	size     int
+	base     uint32
+	capacity uint32
+	next     uint32 // offsets up to next have been handed out before
+	byHost   *simplelru.LRU[string, uint32]
+	byOffset map[uint32]string
+}
+
+func newFakeIPPool(network *net.IPNet, size int) *fakeIPPool {
+	ones, bits := network.Mask.Size()
+	// The network and broadcast addresses are never handed out.
+	capacity := uint32(1)<<(bits-ones) - 2
+	if size > 0 && uint32(size) < capacity {
+		capacity = uint32(size)
+	}
+
+	byHost, _ := simplelru.NewLRU[string, uint32](int(capacity), nil)
+	return &fakeIPPool{
+		network:  network,
+		size:     size,
+		base:     binary.BigEndian.Uint32(network.IP.To4()),
+		capacity: capacity,
+		byHost:   byHost,
+		byOffset: make(map[uint32]string),
+	}
+}
+
+func (p *fakeIPPool) ip(offset uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, p.base+offset)
+	return ip
+}
+
+// offset returns the position of ip in the network, counting from 1.
+func (p *fakeIPPool) offset(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.network.Contains(ip4) {
+		return 0, false
+	}
+	offset := binary.BigEndian.Uint32(ip4) - p.base
+	return offset, offset >= 1 && offset <= p.capacity
+}
+
+func (p *fakeIPPool) allocate(host string) net.IP {
+	if offset, exists := p.byHost.Get(host); exists {
+		return p.ip(offset)
+	}
+
+	var offset uint32
+	for p.next < p.capacity {
+		p.next++
+		if _, used := p.byOffset[p.next]; !used {
+			offset = p.next
+			break
+		}
+	}
+	if offset == 0 {
+		_, offset, _ = p.byHost.RemoveOldest()
+		delete(p.byOffset, offset)
+	}
+
+	p.byHost.Add(host, offset)
+	p.byOffset[offset] = host
+	return p.ip(offset)
+}
+
+func (p *fakeIPPool) host(ip net.IP) (string, bool) {
+	offset, ok := p.offset(ip)
+	if !ok {
+		return "", false
+	}
+	host, exists := p.byOffset[offset]
+	if exists {
+		p.byHost.Get(host)
+	}
+	return host, exists
+}
+
+// SetFakeIPRange hands out fake IPs from network for up to size names, or
+// turns them off when network is nil. The mapping is kept while neither
+// changes.
+func (c *CacheManager) SetFakeIPRange(network *net.IPNet, size int) {
+	c.fakeIPMu.Lock()
+	defer c.fakeIPMu.Unlock()
+
+	if network == nil {
+		c.fakeIPs = nil
+		return
+	}
+	if c.fakeIPs != nil && c.fakeIPs.network.String() == network.String() && c.fakeIPs.size == size {
+		return
+	}
+	c.fakeIPs = newFakeIPPool(network, size)
+}
+
+// HasFakeIPs reports whether fake IPs are handed out.
+func (c *CacheManager) HasFakeIPs() bool {
+	c.fakeIPMu.Lock()
+	defer c.fakeIPMu.Unlock()
+
+	return c.fakeIPs != nil
+}
+
+// FakeIP returns the fake IP of host, handing out a new one if needed, or
+// nil when fake IPs are off.
+func (c *CacheManager) FakeIP(host string) net.IP {
+	c.fakeIPMu.Lock()
+	defer c.fakeIPMu.Unlock()
+
+	if c.fakeIPs == nil {
+		return nil
+	}
+	return c.fakeIPs.allocate(host)
+}
+
+// IsFakeIP reports whether ip belongs to the fake IP range.
+func (c *CacheManager) IsFakeIP(ip net.IP) bool {
+	c.fakeIPMu.Lock()
+	defer c.fakeIPMu.Unlock()
+
+	return c.fakeIPs != nil && c.fakeIPs.network.Contains(ip)
+}
+
+// FakeIPHost returns the name the fake IP ip was handed out for, and false
+// when it is not mapped.
+func (c *CacheManager) FakeIPHost(ip net.IP) (string, bool) {
+	c.fakeIPMu.Lock()
+	defer c.fakeIPMu.Unlock()
+
+	if c.fakeIPs == nil {
+		return "", false
+	}
+	return c.fakeIPs.host(ip)
+}
+
+// FakeIPRecords returns the fake IP mapping, least recently used first.
+func (c *CacheManager) FakeIPRecords() []FakeIPRecord {
+	c.fakeIPMu.Lock()
+	defer c.fakeIPMu.Unlock()
+
+	if c.fakeIPs == nil {
+		return nil
+	}
+	var records []FakeIPRecord
+	for _, host := range c.fakeIPs.byHost.Keys() {
+		offset, _ := c.fakeIPs.byHost.Peek(host)
+		records = append(records, FakeIPRecord{Host: host, IP: c.fakeIPs.ip(offset)})
+	}
+	return records
+}
+
+// RestoreFakeIPs adds saved mappings that fit the current range, unless
+// their name or address is already mapped.
+func (c *CacheManager) RestoreFakeIPs(records []FakeIPRecord) {
+	c.fakeIPMu.Lock()
+	defer c.fakeIPMu.Unlock()
+
+	pool := c.fakeIPs
+	if pool == nil {
+		return
+	}
+	for _, record := range records {
+		offset, ok := pool.offset(record.IP)
+		if !ok || pool.byHost.Contains(record.Host) {
+			continue
+		}
+		if _, used := pool.byOffset[offset]; used {
+			continue
+		}
+		if pool.byHost.Len() >= int(pool.capacity) {
+			_, oldOffset, _ := pool.byHost.RemoveOldest()
+			delete(pool.byOffset, oldOffset)
+		}
+		pool.byHost.Add(record.Host, offset)
+		pool.byOffset[offset] = record.Host
+	}
+}
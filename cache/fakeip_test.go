@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"net"
+	"testing"
+)
+
+func newFakeIPCache(t *testing.T, cidr string, size int) *CacheManager {
+	t.Helper()
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCacheManager()
+	c.SetFakeIPRange(network, size)
+	return c
+}
+
+func TestFakeIPAllocation(t *testing.T) {
+	c := newFakeIPCache(t, "198.18.0.0/24", 0)
+
+	first := c.FakeIP("a.example")
+	second := c.FakeIP("b.example")
+	if first.String() != "198.18.0.1" || second.String() != "198.18.0.2" {
+		t.Fatalf("got %s and %s, want the first addresses of the range", first, second)
+	}
+	if again := c.FakeIP("a.example"); !again.Equal(first) {
+		t.Errorf("a.example got %s, then %s", first, again)
+	}
+
+	if host, ok := c.FakeIPHost(second); !ok || host != "b.example" {
+		t.Errorf("FakeIPHost(%s) = %q, %v, want b.example", second, host, ok)
+	}
+	if _, ok := c.FakeIPHost(net.ParseIP("198.18.0.3")); ok {
+		t.Error("address never handed out is mapped")
+	}
+	if !c.IsFakeIP(net.ParseIP("198.18.0.200")) || c.IsFakeIP(net.ParseIP("192.0.2.1")) {
+		t.Error("IsFakeIP does not follow the range")
+	}
+}
+
+func TestFakeIPEvictsLeastRecentlyUsed(t *testing.T) {
+	// A /30 has two usable addresses.
+	c := newFakeIPCache(t, "198.18.0.0/30", 0)
+
+	a := c.FakeIP("a.example")
+	b := c.FakeIP("b.example")
+
+	// Using the address of a.example keeps it, so b.example is evicted.
+	if host, _ := c.FakeIPHost(a); host != "a.example" {
+		t.Fatalf("FakeIPHost(%s) = %q", a, host)
+	}
+	d := c.FakeIP("d.example")
+	if !d.Equal(b) {
+		t.Fatalf("d.example got %s, want the address of the evicted b.example, %s", d, b)
+	}
+	if host, _ := c.FakeIPHost(b); host != "d.example" {
+		t.Errorf("FakeIPHost(%s) = %q, want d.example", b, host)
+	}
+	if again := c.FakeIP("a.example"); !again.Equal(a) {
+		t.Errorf("a.example moved from %s to %s", a, again)
+	}
+}
+
+func TestFakeIPSizeLimit(t *testing.T) {
+	c := newFakeIPCache(t, "198.18.0.0/24", 3)
+
+	for _, host := range []string{"a", "b", "c", "d"} {
+		c.FakeIP(host)
+	}
+	records := c.FakeIPRecords()
+	if len(records) != 3 {
+		t.Fatalf("%d names mapped, want 3", len(records))
+	}
+	if records[0].Host != "b" {
+		t.Errorf("least recently used is %s, want b", records[0].Host)
+	}
+	if ip := c.FakeIP("a"); ip.String() != "198.18.0.2" {
+		t.Errorf("a got %s, want the address of the evicted b", ip)
+	}
+}
+
+func TestFakeIPRestore(t *testing.T) {
+	c := newFakeIPCache(t, "198.18.0.0/24", 0)
+	c.FakeIP("a.example")
+	records := c.FakeIPRecords()
+
+	restored := newFakeIPCache(t, "198.18.0.0/24", 0)
+	restored.FakeIP("taken.example")
+	restored.RestoreFakeIPs(append(records, FakeIPRecord{Host: "outside.example", IP: net.ParseIP("192.0.2.1")}))
+
+	if host, _ := restored.FakeIPHost(net.ParseIP("198.18.0.1")); host != "taken.example" {
+		t.Errorf("restore replaced the mapping of %s", host)
+	}
+	if _, ok := restored.FakeIPHost(net.ParseIP("192.0.2.1")); ok {
+		t.Error("address outside the range was restored")
+	}
+
+	fresh := newFakeIPCache(t, "198.18.0.0/24", 0)
+	fresh.RestoreFakeIPs(records)
+	if host, _ := fresh.FakeIPHost(net.ParseIP("198.18.0.1")); host != "a.example" {
+		t.Errorf("FakeIPHost() = %q after restore, want a.example", host)
+	}
+	if ip := fresh.FakeIP("new.example"); ip.String() != "198.18.0.2" {
+		t.Errorf("new name got %s, a restored address", ip)
+	}
+}
+
+func TestFakeIPOff(t *testing.T) {
+	c := newFakeIPCache(t, "198.18.0.0/24", 0)
+	ip := c.FakeIP("a.example")
+
+	c.SetFakeIPRange(nil, 0)
+	if c.HasFakeIPs() || c.FakeIP("a.example") != nil || c.IsFakeIP(ip) {
+		t.Error("fake IPs still handed out after turning them off")
+	}
+}
@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStaticHost(t *testing.T) {
+	resolver := &fakeResolver{ips: []net.IP{net.ParseIP("192.0.2.99")}}
+	c := newTestCache(resolver)
+	c.SetStaticHosts(map[string][]net.IP{
+		"nas.lan":       {net.ParseIP("192.0.2.1")},
+		"*.lan":         {net.ParseIP("192.0.2.2")},
+		"*.printer.lan": {net.ParseIP("192.0.2.3")},
+	})
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"nas.lan", "192.0.2.1"},
+		{"NAS.lan.", "192.0.2.1"},
+		{"lan", "192.0.2.2"},
+		{"tv.lan", "192.0.2.2"},
+		{"printer.lan", "192.0.2.3"},
+		{"tray.printer.lan", "192.0.2.3"},
+		{"example.com", "192.0.2.99"},
+	}
+	for _, tt := range tests {
+		ips, err := c.ResolveHost(tt.host)
+		if err != nil || len(ips) != 1 || ips[0].String() != tt.want {
+			t.Errorf("ResolveHost(%q) = %v, %v, want %s", tt.host, ips, err, tt.want)
+		}
+	}
+	if calls := resolver.callCount(); calls != 1 {
+		t.Errorf("resolver called %d times, want only for the name not pinned", calls)
+	}
+
+	c.SetStaticHosts(nil)
+	if c.HasStaticHosts() {
+		t.Error("static hosts still set after clearing them")
+	}
+	if _, pinned := c.StaticHost("nas.lan"); pinned {
+		t.Error("nas.lan still pinned after clearing the static hosts")
+	}
+}
@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingResolver answers lookups once release is closed.
+type blockingResolver struct {
+	fakeResolver
+	release chan struct{}
+}
+
+func (r *blockingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	<-r.release
+	return r.fakeResolver.LookupIP(ctx, host)
+}
+
+// waitFor polls until condition holds, failing the test after a while.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrentLookupsAreShared(t *testing.T) {
+	resolver := &blockingResolver{
+		fakeResolver: fakeResolver{ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Minute},
+		release:      make(chan struct{}),
+	}
+	c := newTestCache(resolver)
+
+	var wg sync.WaitGroup
+	results := make([][]net.IP, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = c.ResolveHost("example.com")
+		}()
+	}
+	waitFor(t, "the lookup to start", func() bool {
+		c.lookupMu.Lock()
+		defer c.lookupMu.Unlock()
+		return len(c.lookups) == 1
+	})
+	time.Sleep(10 * time.Millisecond)
+	close(resolver.release)
+	wg.Wait()
+
+	if calls := resolver.callCount(); calls != 1 {
+		t.Errorf("%d lookups, want 1 shared by all callers", calls)
+	}
+	for i, ips := range results {
+		if len(ips) != 1 {
+			t.Errorf("caller %d got %v", i, ips)
+		}
+	}
+}
+
+func TestResolveHostPrefetchesExpiringAddresses(t *testing.T) {
+	resolver := &fakeResolver{ips: []net.IP{net.ParseIP("192.0.2.2")}, ttl: time.Hour}
+	c := newTestCache(resolver)
+	c.RestoreDNSRecords([]DNSRecord{
+		// A tenth of the TTL left.
+		{Host: "expiring.example", IPs: []net.IP{net.ParseIP("192.0.2.1")}, TTL: time.Hour, Expires: time.Now().Add(5 * time.Minute)},
+		{Host: "fresh.example", IPs: []net.IP{net.ParseIP("192.0.2.1")}, TTL: time.Hour, Expires: time.Now().Add(30 * time.Minute)},
+	})
+
+	// The cached addresses are answered at once and refreshed behind.
+	if ips, _ := c.ResolveHost("expiring.example"); len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Fatalf("ResolveHost() = %v, want the cached address", ips)
+	}
+	waitFor(t, "the prefetch", func() bool {
+		ips, _ := c.ResolveHost("expiring.example")
+		return len(ips) == 1 && ips[0].String() == "192.0.2.2"
+	})
+	if remaining := expiresIn(t, c, "expiring.example"); remaining < 59*time.Minute {
+		t.Errorf("refreshed lookup cached for %v, want 1h", remaining)
+	}
+
+	c.ResolveHost("fresh.example")
+	time.Sleep(10 * time.Millisecond)
+	if calls := resolver.callCount(); calls != 1 {
+		t.Errorf("%d lookups, want only the prefetch of the expiring address", calls)
+	}
+}
+
+// cancellableResolver answers lookups once release is closed, or fails them
+// when their context is done, reporting it on cancelled.
+type cancellableResolver struct {
+	fakeResolver
+	release   chan struct{}
+	cancelled chan struct{}
+}
+
+func (r *cancellableResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	select {
+	case <-r.release:
+		return r.fakeResolver.LookupIP(ctx, host)
+	case <-ctx.Done():
+		close(r.cancelled)
+		return nil, 0, ctx.Err()
+	}
+}
+
+func TestResolveHostContext(t *testing.T) {
+	newResolver := func() *cancellableResolver {
+		return &cancellableResolver{
+			fakeResolver: fakeResolver{ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Minute},
+			release:      make(chan struct{}),
+			cancelled:    make(chan struct{}),
+		}
+	}
+
+	t.Run("last caller cancels the lookup", func(t *testing.T) {
+		resolver := newResolver()
+		c := newTestCache(resolver)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := c.ResolveHostContext(ctx, "example.com"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("ResolveHostContext() = %v, want the deadline of the caller", err)
+		}
+		select {
+		case <-resolver.cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("lookup still running after its only caller left")
+		}
+		if _, cached := c.DNSExpiry("example.com"); cached {
+			t.Error("cancelled lookup was cached")
+		}
+	})
+
+	t.Run("lookup outlives a caller leaving", func(t *testing.T) {
+		resolver := newResolver()
+		c := newTestCache(resolver)
+
+		result := make(chan []net.IP)
+		go func() {
+			ips, _ := c.ResolveHost("example.com")
+			result <- ips
+		}()
+		waitFor(t, "the lookup to start", func() bool {
+			c.lookupMu.Lock()
+			defer c.lookupMu.Unlock()
+			return len(c.lookups) == 1
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := c.ResolveHostContext(ctx, "example.com"); !errors.Is(err, context.Canceled) {
+			t.Errorf("ResolveHostContext() = %v, want the cancellation of the caller", err)
+		}
+
+		close(resolver.release)
+		if ips := <-result; len(ips) != 1 {
+			t.Errorf("remaining caller got %v", ips)
+		}
+		select {
+		case <-resolver.cancelled:
+			t.Error("lookup cancelled while a caller still waited for it")
+		default:
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"goProxy/logger"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AuthRequired reports whether inbound clients must authenticate. The removed
+// socksUsers map of older configs still requires it, so that upgrading does
+// not open the proxy; its plaintext passwords are not accepted.
+func (c *ProxyConfig) AuthRequired() bool {
+	return c.AuthFile != "" || len(c.LegacySocksUsers) > 0
+}
+
+// GetAuthUsers returns the password hashes of the auth file by username.
+func (c *ProxyConfig) GetAuthUsers() map[string]string {
+	return c.authUsers
+}
+
+// loadAuthFile reads the htpasswd file. If it cannot be read no user is
+// accepted, so that a broken file does not open the proxy to everyone.
+func (c *ProxyConfig) loadAuthFile() {
+	c.authUsers = make(map[string]string)
+	if len(c.LegacySocksUsers) > 0 {
+		logger.Error("socksUsers is no longer supported, only users of authFile are accepted; move its users there")
+	}
+	if c.AuthFile == "" {
+		return
+	}
+
+	path := resolvePath(c.AuthFile, filepath.Dir(c.configPath))
+	users, err := parseHtpasswd(path)
+	if err != nil {
+		logger.Error("Failed to load auth file, rejecting all clients: %v", err)
+		return
+	}
+	c.authUsers = users
+}
+
+func parseHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, found := strings.Cut(line, ":")
+		if !found || username == "" {
+			logger.Warn("Auth file %s line %d is not 'user:hash', skipping", path, lineNumber)
+			continue
+		}
+		if !isSupportedHash(hash) {
+			logger.Warn("Auth file %s: user '%s' has an unsupported hash, use bcrypt or SHA", path, username)
+			continue
+		}
+		users[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	return users, nil
+}
+
+func isSupportedHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
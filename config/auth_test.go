@@ -0,0 +1,58 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "htpasswd", `# users
+alice:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC
+bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+
+carol:$apr1$abcdefgh$0123456789abcdefghijkl
+not a user line
+:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`)
+
+	users, err := parseHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"alice": "$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC",
+		"bob":   "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("parseHtpasswd() = %v, want %v", users, want)
+	}
+}
+
+func TestAuthFile(t *testing.T) {
+	cfg := loadTestConfig(t, `
+defaultProxy: direct
+authFile: htpasswd
+rules: []
+`)
+	// The file is looked up next to the config and does not exist.
+	if !cfg.AuthRequired() || len(cfg.GetAuthUsers()) != 0 {
+		t.Errorf("missing auth file: required %v, users %v, want every client rejected", cfg.AuthRequired(), cfg.GetAuthUsers())
+	}
+
+	path := writeTestFile(t, t.TempDir(), "htpasswd", "bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+	cfg = loadTestConfig(t, "defaultProxy: direct\nauthFile: "+filepath.ToSlash(path)+"\nrules: []\n")
+	if _, exists := cfg.GetAuthUsers()["bob"]; !exists {
+		t.Errorf("users = %v, want bob", cfg.GetAuthUsers())
+	}
+
+	cfg = loadTestConfig(t, "defaultProxy: direct\nrules: []\n")
+	if cfg.AuthRequired() {
+		t.Error("authentication required without an auth file")
+	}
+
+	cfg = loadTestConfig(t, "defaultProxy: direct\nsocksUsers:\n  alice: secret\nrules: []\n")
+	if !cfg.AuthRequired() || len(cfg.GetAuthUsers()) != 0 {
+		t.Errorf("removed socksUsers: required %v, users %v, want every client rejected", cfg.AuthRequired(), cfg.GetAuthUsers())
+	}
+}
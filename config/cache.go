@@ -22,6 +22,12 @@ func getCacheDir() string {
 	return cacheDir
 }
 
+// GetLookupCachePath returns the file DNS answers and routing decisions are
+// saved to across restarts.
+func GetLookupCachePath() string {
+	return filepath.Join(getCacheDir(), "lookup_cache.json")
+}
+
 func getCacheFilePath(url string) string {
 	baseName := filepath.Base(url)
 	if baseName == "" || baseName == "." || baseName == "/" {
@@ -13,11 +13,11 @@ import (
 func LoadConfig(configPath string, cacheManager *cache.CacheManager, cacheOnly bool) (*ProxyConfig, error) {
 	config := &ProxyConfig{
 		DefaultProxy: "direct",
-		Proxies: map[string]string{
-			"socks5": "socks5://localhost:1080",
-			"http":   "http://localhost:8081",
-			"direct": "",
-			"block":  "#",
+		Proxies: map[string]*ProxyEntry{
+			"socks5": NewProxyEntry("socks5://localhost:1080"),
+			"http":   NewProxyEntry("http://localhost:8081"),
+			"direct": NewProxyEntry(""),
+			"block":  NewProxyEntry("#"),
 		},
 		ListenAddr:  ":8080",
 		LogLevel:    "info",
@@ -86,6 +86,12 @@ func (c *ProxyConfig) afterLoad(httpClientFunc HTTPClientFunc) {
 	c.logLevelInt = parseLogLevel(c.LogLevel)
 	logger.ReconfigureGlobalLogger(c)
 
+	c.prepareProxies()
+	c.prepareListeners()
+	c.prepareDNS()
+	c.loadAuthFile()
+	c.loadHosts()
+
 	configDir := filepath.Dir(c.configPath)
 
 	c.preParseRuleLists(configDir, false, httpClientFunc)
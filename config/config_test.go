@@ -0,0 +1,41 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"goProxy/cache"
+)
+
+// loadTestConfig loads a config from YAML in a temporary directory, which is
+// also the profile directory. Logging goes to stdout at the error level.
+func loadTestConfig(t *testing.T, yaml string) *ProxyConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("PROFILE_PLACE", dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	yaml += "\nlogLevel: error\nlogFile: \"\"\n"
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path, cache.NewCacheManager(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// writeTestFile writes content to the file name in dir and returns its path.
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
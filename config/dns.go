@@ -0,0 +1,263 @@
+package config
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"goProxy/cache"
+	"goProxy/logger"
+	"goProxy/resolver"
+)
+
+const (
+	DNSBlockNXDomain = "nxdomain"
+	DNSBlockZero     = "zero"
+
+	// DNSUpstreamSystem forwards the queries of DNS listeners to the system
+	// resolver.
+	DNSUpstreamSystem = resolver.SystemServer
+
+	DefaultFakeIPRange = "198.18.0.0/15"
+	DefaultFakeIPSize  = 65536
+)
+
+var resolvConfPath = "/etc/resolv.conf"
+
+// GetDNSUpstream returns the host:port of the resolver DNS listeners forward
+// queries to when there are no dns servers, DNSUpstreamSystem for the system
+// resolver, or "" when they use the dns servers or there is none.
+func (c *ProxyConfig) GetDNSUpstream() string {
+	return c.dnsUpstream
+}
+
+// GetDNSServers returns the servers of the dns section, which lookups and
+// DNS listeners use, or the deprecated dnsUpstream when there are none.
+func (c *ProxyConfig) GetDNSServers() []string {
+	return c.dnsServers
+}
+
+// GetDNSBlockResponse returns how DNS listeners answer queries for blocked
+// names: DNSBlockNXDomain or DNSBlockZero.
+func (c *ProxyConfig) GetDNSBlockResponse() string {
+	if c.DNSBlockResponse == DNSBlockZero {
+		return DNSBlockZero
+	}
+	return DNSBlockNXDomain
+}
+
+// HasDNSServers reports whether the dns section, or the deprecated
+// dnsUpstream, configures any server.
+func (c *ProxyConfig) HasDNSServers() bool {
+	return len(c.dnsServers) > 0
+}
+
+// GetDNSTTLs returns the bounds of the TTLs resolved addresses are cached
+// for, and how long failed lookups are cached at most.
+func (c *ProxyConfig) GetDNSTTLs() (minTTL, maxTTL, negativeTTL time.Duration) {
+	dns := c.DNS
+	if dns == nil {
+		dns = &DNSConfig{}
+	}
+	minTTL = timeoutSeconds(dns.MinTTLSeconds, 0, cache.DefaultMinTTL)
+	maxTTL = max(timeoutSeconds(dns.MaxTTLSeconds, 0, cache.DefaultMaxTTL), minTTL)
+	negativeTTL = timeoutSeconds(dns.NegativeTTLSeconds, 0, cache.DefaultNegativeTTL)
+	return
+}
+
+// GetFakeIPRange returns the network fake IPs are handed out from, or nil
+// when fake IPs are off.
+func (c *ProxyConfig) GetFakeIPRange() *net.IPNet {
+	return c.fakeIPRange
+}
+
+// GetFakeIPSize returns how many names are mapped to fake IPs at most.
+func (c *ProxyConfig) GetFakeIPSize() int {
+	if c.FakeIP == nil || c.FakeIP.Size <= 0 {
+		return DefaultFakeIPSize
+	}
+	return c.FakeIP.Size
+}
+
+// GetFakeIPExclude returns the host patterns DNS listeners answer with real
+// addresses in fake IP mode.
+func (c *ProxyConfig) GetFakeIPExclude() []string {
+	return c.fakeIPExclude
+}
+
+// PersistFakeIPs reports whether the fake IP mapping is kept across restarts.
+func (c *ProxyConfig) PersistFakeIPs() bool {
+	return c.fakeIPRange != nil && c.FakeIP.Persist
+}
+
+func (c *ProxyConfig) prepareDNS() {
+	if c.DNSBlockResponse != "" && c.DNSBlockResponse != DNSBlockNXDomain && c.DNSBlockResponse != DNSBlockZero {
+		logger.Warn("Unknown dnsBlockResponse '%s', using %s", c.DNSBlockResponse, DNSBlockNXDomain)
+	}
+
+	if c.DNS != nil && c.DNS.Proxy != "" {
+		if _, exists := c.Proxies[c.DNS.Proxy]; !exists {
+			logger.Warn("DNS uses unknown proxy '%s', querying servers directly", c.DNS.Proxy)
+			c.DNS.Proxy = ""
+		}
+	}
+
+	if c.DNS != nil && c.DNS.MaxTTLSeconds > 0 && c.DNS.MaxTTLSeconds < c.DNS.MinTTLSeconds {
+		logger.Warn("DNS maxTTLSeconds %d is below minTTLSeconds %d, using %d", c.DNS.MaxTTLSeconds, c.DNS.MinTTLSeconds, c.DNS.MinTTLSeconds)
+	}
+
+	c.prepareFakeIP()
+
+	c.dnsServers = c.chooseDNSServers()
+	c.dnsUpstream = c.chooseDNSUpstream()
+}
+
+// chooseDNSServers returns the dns servers. dnsUpstream is a deprecated alias
+// for them: it is used with a port when there are none, unless it is a DNS
+// listener of goProxy itself, as queries would loop.
+func (c *ProxyConfig) chooseDNSServers() []string {
+	var servers []string
+	if c.DNS != nil {
+		servers = c.DNS.Servers
+	}
+
+	upstream := c.DNSUpstream
+	switch {
+	case upstream == "":
+		return servers
+	case len(servers) > 0:
+		logger.Warn("dnsUpstream is deprecated and ignored, dns.servers is used")
+		return servers
+	}
+
+	if upstream != DNSUpstreamSystem {
+		upstream = withDNSPort(upstream)
+	}
+	if c.isDNSListener(upstream) {
+		logger.Error("dnsUpstream %s is a DNS listener of goProxy, ignoring it", upstream)
+		return nil
+	}
+	logger.Warn("dnsUpstream is deprecated, set dns.servers instead")
+	return []string{upstream}
+}
+
+// chooseDNSUpstream returns the resolver DNS listeners forward to when there
+// are no dns servers: the first nameserver of /etc/resolv.conf or the system
+// resolver. A nameserver that is a DNS listener of goProxy itself is
+// rejected, as queries would loop.
+func (c *ProxyConfig) chooseDNSUpstream() string {
+	if c.HasDNSServers() {
+		return ""
+	}
+
+	nameserver := systemNameserver()
+	if nameserver == "" {
+		return DNSUpstreamSystem
+	}
+	nameserver = withDNSPort(nameserver)
+	if c.isDNSListener(nameserver) {
+		logger.Error("The system nameserver %s is a DNS listener of goProxy, set dns.servers to forward queries", nameserver)
+		return ""
+	}
+	return nameserver
+}
+
+// isDNSListener reports whether queries sent to upstream reach a DNS
+// listener of this config, such as "127.0.0.1:53" for a listener on ":53".
+func (c *ProxyConfig) isDNSListener(upstream string) bool {
+	upstreamHost, upstreamPort, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return false
+	}
+	upstreamIP := net.ParseIP(upstreamHost)
+
+	for _, listener := range c.GetListeners() {
+		if listener.GetProtocol() != ProtocolDNS {
+			continue
+		}
+		host, port, err := net.SplitHostPort(listener.Addr)
+		if err != nil || port != upstreamPort {
+			continue
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case host == "" || (ip != nil && ip.IsUnspecified()):
+			if upstreamIP != nil && (upstreamIP.IsLoopback() || isLocalIP(upstreamIP)) {
+				return true
+			}
+		case ip != nil && upstreamIP != nil:
+			if ip.Equal(upstreamIP) {
+				return true
+			}
+		case strings.EqualFold(host, upstreamHost):
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether ip is an address of a local interface.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func withDNSPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, "53")
+	}
+	return address
+}
+
+func (c *ProxyConfig) prepareFakeIP() {
+	c.fakeIPRange = nil
+	c.fakeIPExclude = nil
+	if c.FakeIP == nil {
+		return
+	}
+
+	fakeRange := c.FakeIP.Range
+	if fakeRange == "" {
+		fakeRange = DefaultFakeIPRange
+	}
+	_, ipNet, err := net.ParseCIDR(fakeRange)
+	if err != nil || ipNet.IP.To4() == nil {
+		logger.Error("Invalid fakeIP range '%s', fake IPs are off: must be an IPv4 CIDR", fakeRange)
+		return
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > 30 {
+		logger.Error("fakeIP range '%s' is too small, fake IPs are off", fakeRange)
+		return
+	}
+
+	c.fakeIPRange = ipNet
+	c.fakeIPExclude = parseStringToList(c.FakeIP.Exclude, true)
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf.
+func systemNameserver() string {
+	file, err := os.Open(resolvConfPath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return ""
+}
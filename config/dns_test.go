@@ -0,0 +1,58 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withResolvConf points resolvConfPath at a file with content, or at a
+// missing file when content is empty, for the rest of the test.
+func withResolvConf(t *testing.T, content string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resolv.conf")
+	if content != "" {
+		writeTestFile(t, dir, "resolv.conf", content)
+	}
+
+	previous := resolvConfPath
+	resolvConfPath = path
+	t.Cleanup(func() { resolvConfPath = previous })
+}
+
+func TestDNSUpstream(t *testing.T) {
+	tests := []struct {
+		name        string
+		resolvConf  string
+		yaml        string
+		want        string
+		wantServers []string
+	}{
+		{"deprecated upstream without port", "nameserver 10.0.0.1\n", `dnsUpstream: "1.1.1.1"`, "", []string{"1.1.1.1:53"}},
+		{"deprecated system upstream", "nameserver 10.0.0.1\n", `dnsUpstream: system`, "", []string{DNSUpstreamSystem}},
+		{"dns servers", "nameserver 10.0.0.1\n", "dns:\n  servers: [\"9.9.9.9\"]", "", []string{"9.9.9.9"}},
+		{"dns servers before the deprecated upstream", "nameserver 10.0.0.1\n", "dnsUpstream: \"1.1.1.1\"\ndns:\n  servers: [\"9.9.9.9\"]", "", []string{"9.9.9.9"}},
+		{"resolv.conf", "# comment\nnameserver 10.0.0.1\nnameserver 10.0.0.2\n", "", "10.0.0.1:53", nil},
+		{"no resolv.conf", "", "", DNSUpstreamSystem, nil},
+		{"deprecated upstream loop", "nameserver 10.0.0.1\n", "dnsListenAddr: \"127.0.0.1:5353\"\ndnsUpstream: \"127.0.0.1:5353\"", "10.0.0.1:53", nil},
+		{"loop through a wildcard listener", "nameserver 10.0.0.1\n", "dnsListenAddr: \":5353\"\ndnsUpstream: \"127.0.0.1:5353\"", "10.0.0.1:53", nil},
+		{"other port", "nameserver 10.0.0.1\n", "dnsListenAddr: \":5353\"\ndnsUpstream: \"127.0.0.1:53\"", "", []string{"127.0.0.1:53"}},
+		{"resolv.conf loop", "nameserver 127.0.0.1\n", "dnsListenAddr: \"127.0.0.1:53\"", "", nil},
+		{"named listener loop", "", "listeners:\n  - name: dns\n    addr: \"[::1]:53\"\n    protocol: dns\ndnsUpstream: \"::1\"", DNSUpstreamSystem, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withResolvConf(t, tt.resolvConf)
+			cfg := loadTestConfig(t, "defaultProxy: direct\nrules: []\n"+tt.yaml)
+			if got := cfg.GetDNSUpstream(); got != tt.want {
+				t.Errorf("GetDNSUpstream() = %q, want %q", got, tt.want)
+			}
+			if got := cfg.GetDNSServers(); !reflect.DeepEqual(got, tt.wantServers) {
+				t.Errorf("GetDNSServers() = %q, want %q", got, tt.wantServers)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"bufio"
+	"goProxy/logger"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GetStaticHosts returns the addresses of the hosts and hostsFile entries by
+// lowercase hostname or *.domain pattern.
+func (c *ProxyConfig) GetStaticHosts() map[string][]net.IP {
+	return c.staticHosts
+}
+
+// loadHosts merges hostsFile and hosts, whose entries replace those of the
+// file for the same name.
+func (c *ProxyConfig) loadHosts() {
+	c.staticHosts = make(map[string][]net.IP)
+
+	if c.HostsFile != "" {
+		path := resolvePath(c.HostsFile, filepath.Dir(c.configPath))
+		if err := parseHostsFile(path, c.staticHosts); err != nil {
+			logger.Error("Failed to load hosts file: %v", err)
+		}
+	}
+
+	for name, addresses := range c.Hosts {
+		var ips []net.IP
+		for _, address := range strings.Fields(strings.ReplaceAll(addresses, ",", " ")) {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				logger.Warn("Hosts entry '%s' has invalid address '%s', skipping it", name, address)
+				continue
+			}
+			ips = append(ips, ip)
+		}
+		if len(ips) > 0 {
+			c.staticHosts[normalizeHostName(name)] = ips
+		}
+	}
+}
+
+// parseHostsFile adds the entries of a file in /etc/hosts format to hosts.
+// Names listed on several lines get the addresses of all of them.
+func parseHostsFile(path string, hosts map[string][]net.IP) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			logger.Warn("Hosts file %s line %d is not 'address name...', skipping", path, lineNumber)
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = normalizeHostName(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return scanner.Err()
+}
+
+func normalizeHostName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
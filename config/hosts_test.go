@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseHostsFile(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "hosts", `# static hosts
+127.0.0.1	localhost
+192.0.2.10	NAS.lan nas   # trailing comment
+2001:db8::10	nas.lan.
+not-an-ip	broken.lan
+192.0.2.11
+`)
+
+	hosts := make(map[string][]net.IP)
+	if err := parseHostsFile(path, hosts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"localhost": "[127.0.0.1]",
+		"nas.lan":   "[192.0.2.10 2001:db8::10]",
+		"nas":       "[192.0.2.10]",
+	}
+	if len(hosts) != len(want) {
+		t.Errorf("got %v, want %v", hosts, want)
+	}
+	for name, ips := range want {
+		if got := fmt.Sprint(hosts[name]); got != ips {
+			t.Errorf("%s = %s, want %s", name, got, ips)
+		}
+	}
+}
+
+func TestHostsOverrideHostsFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "hosts", "192.0.2.10 nas.lan printer.lan\n")
+	t.Setenv("PROFILE_PLACE", dir)
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+defaultProxy: direct
+hostsFile: %q
+hosts:
+  NAS.lan: "192.0.2.20, 2001:db8::20"
+  "*.dev.lan": "192.0.2.30 invalid"
+  empty.lan: "invalid"
+rules: []
+`, dir+"/hosts"))
+
+	want := map[string]string{
+		"nas.lan":     "[192.0.2.20 2001:db8::20]",
+		"printer.lan": "[192.0.2.10]",
+		"*.dev.lan":   "[192.0.2.30]",
+	}
+	hosts := cfg.GetStaticHosts()
+	if len(hosts) != len(want) {
+		t.Errorf("got %v, want %v", hosts, want)
+	}
+	for name, ips := range want {
+		if got := fmt.Sprint(hosts[name]); got != ips {
+			t.Errorf("%s = %s, want %s", name, got, ips)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"goProxy/logger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProtocolHTTP   = "http"
+	ProtocolSocks5 = "socks5"
+	ProtocolDNS    = "dns"
+
+	unixAddrPrefix = "unix:"
+)
+
+// GetListeners returns the configured listeners, or the ones implied by
+// listenAddr, socksListenAddr and dnsListenAddr when no listeners are
+// configured.
+func (c *ProxyConfig) GetListeners() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+
+	listeners := []ListenerConfig{{
+		Name:        ProtocolHTTP,
+		Addr:        c.ListenAddr,
+		Protocol:    ProtocolHTTP,
+		SocketMode:  c.SocketMode,
+		SocketOwner: c.SocketOwner,
+		TLS:         c.ListenTLS,
+	}}
+	if c.SocksListenAddr != "" {
+		listeners = append(listeners, ListenerConfig{
+			Name:        ProtocolSocks5,
+			Addr:        c.SocksListenAddr,
+			Protocol:    ProtocolSocks5,
+			SocketMode:  c.SocketMode,
+			SocketOwner: c.SocketOwner,
+		})
+	}
+	if c.DNSListenAddr != "" {
+		listeners = append(listeners, ListenerConfig{
+			Name:     ProtocolDNS,
+			Addr:     c.DNSListenAddr,
+			Protocol: ProtocolDNS,
+		})
+	}
+	return listeners
+}
+
+// GetNetwork returns the network and address to listen on: "unix" and the
+// socket path for "unix:/path" addresses, "tcp" and the address otherwise.
+func (l *ListenerConfig) GetNetwork() (network, addr string) {
+	if path, ok := strings.CutPrefix(l.Addr, unixAddrPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", l.Addr
+}
+
+// GetSocketMode returns the file mode of a unix socket listener, or 0 to
+// keep the mode given by the umask.
+func (l *ListenerConfig) GetSocketMode() os.FileMode {
+	mode, err := parseSocketMode(l.SocketMode)
+	if err != nil {
+		return 0
+	}
+	return mode
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("invalid socket mode '%s'", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+// GetProtocol returns the protocol of the listener, http by default.
+func (l *ListenerConfig) GetProtocol() string {
+	if l.Protocol == "" {
+		return ProtocolHTTP
+	}
+	return l.Protocol
+}
+
+// allRules returns the main rules followed by the rules of every profile.
+func (c *ProxyConfig) allRules() []RuleConfig {
+	rules := c.Rules
+	for _, profile := range c.Profiles {
+		rules = append(rules[:len(rules):len(rules)], profile.Rules...)
+	}
+	return rules
+}
+
+// GetCertificate returns the certificate loaded with the config, or the
+// error that prevented loading it.
+func (t *ListenerTLSConfig) GetCertificate() (*tls.Certificate, error) {
+	return t.certificate, t.loadErr
+}
+
+func (t *ListenerTLSConfig) load(configDir string) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		t.loadErr = fmt.Errorf("certFile and keyFile are required")
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(resolvePath(t.CertFile, configDir), resolvePath(t.KeyFile, configDir))
+	if err != nil {
+		t.loadErr = fmt.Errorf("failed to load certificate: %v", err)
+		return
+	}
+	t.certificate = &cert
+}
+
+func (c *ProxyConfig) prepareListeners() {
+	configDir := filepath.Dir(c.configPath)
+
+	if _, err := parseSocketMode(c.SocketMode); err != nil {
+		logger.Warn("%v, keeping the default mode", err)
+	}
+	if c.ListenTLS != nil {
+		c.ListenTLS.load(configDir)
+	}
+
+	for name, profile := range c.Profiles {
+		if profile == nil {
+			c.Profiles[name] = &RuleProfile{}
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Listeners {
+		listener := &c.Listeners[i]
+		if listener.Name == "" || names[listener.Name] {
+			name := fmt.Sprintf("listener-%d", i+1)
+			if listener.Name != "" {
+				logger.Warn("Listener name '%s' is used more than once, renaming to '%s'", listener.Name, name)
+			}
+			listener.Name = name
+		}
+		names[listener.Name] = true
+
+		if protocol := listener.GetProtocol(); protocol != ProtocolHTTP && protocol != ProtocolSocks5 && protocol != ProtocolDNS {
+			logger.Warn("Listener '%s' has unknown protocol '%s', using http", listener.Name, protocol)
+			listener.Protocol = ProtocolHTTP
+		}
+		if _, err := parseSocketMode(listener.SocketMode); err != nil {
+			logger.Warn("Listener '%s' has %v, keeping the default mode", listener.Name, err)
+		}
+		if listener.GetProtocol() == ProtocolDNS {
+			if network, _ := listener.GetNetwork(); network == "unix" {
+				logger.Warn("DNS listener '%s' cannot use a unix socket", listener.Name)
+			}
+			if listener.TLS != nil {
+				logger.Warn("DNS listener '%s' does not support tls, ignoring it", listener.Name)
+				listener.TLS = nil
+			}
+		}
+		if listener.TLS != nil {
+			listener.TLS.load(configDir)
+		}
+		if listener.Profile != "" {
+			if _, exists := c.Profiles[listener.Profile]; !exists {
+				logger.Warn("Listener '%s' uses unknown profile '%s', using the main rules", listener.Name, listener.Profile)
+				listener.Profile = ""
+			}
+		}
+		if listener.Proxy != "" {
+			if _, exists := c.Proxies[listener.Proxy]; !exists {
+				logger.Warn("Listener '%s' uses unknown proxy '%s', using the rules", listener.Name, listener.Proxy)
+				listener.Proxy = ""
+			}
+		}
+	}
+}
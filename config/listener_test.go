@@ -0,0 +1,70 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestListenerNetwork(t *testing.T) {
+	tests := []struct {
+		addr, network, want string
+	}{
+		{"127.0.0.1:8080", "tcp", "127.0.0.1:8080"},
+		{":1080", "tcp", ":1080"},
+		{"unix:/run/goproxy.sock", "unix", "/run/goproxy.sock"},
+	}
+	for _, tt := range tests {
+		listener := ListenerConfig{Addr: tt.addr}
+		if network, addr := listener.GetNetwork(); network != tt.network || addr != tt.want {
+			t.Errorf("GetNetwork() of %s = %s %s, want %s %s", tt.addr, network, addr, tt.network, tt.want)
+		}
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0660", 0660, false},
+		{"600", 0600, false},
+		{"0999", 0, true},
+		{"1777", 0, true},
+		{"rw-rw----", 0, true},
+	}
+	for _, tt := range tests {
+		mode, err := parseSocketMode(tt.mode)
+		if mode != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseSocketMode(%q) = %v, %v", tt.mode, mode, err)
+		}
+		if got := (&ListenerConfig{SocketMode: tt.mode}).GetSocketMode(); got != tt.want {
+			t.Errorf("GetSocketMode() of %q = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestUnixSocketSettingsApplyToImpliedListeners(t *testing.T) {
+	cfg := loadTestConfig(t, `
+defaultProxy: direct
+listenAddr: "unix:/run/goproxy.sock"
+socksListenAddr: "unix:/run/goproxy-socks.sock"
+dnsListenAddr: "127.0.0.1:5353"
+socketMode: "0660"
+socketOwner: "proxy:proxy"
+rules: []
+`)
+	listeners := cfg.GetListeners()
+	if len(listeners) != 3 {
+		t.Fatalf("got %d listeners, want 3", len(listeners))
+	}
+	for _, listener := range listeners[:2] {
+		if listener.GetSocketMode() != 0660 || listener.SocketOwner != "proxy:proxy" {
+			t.Errorf("listener '%s' got mode %v, owner '%s'", listener.Name, listener.GetSocketMode(), listener.SocketOwner)
+		}
+	}
+	if listeners[2].SocketMode != "" {
+		t.Error("the DNS listener got a socket mode")
+	}
+}
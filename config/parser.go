@@ -53,63 +53,75 @@ func parseStringToList(input string, expandWildcardDomains bool) []string {
 
 func (c *ProxyConfig) preParseRuleLists(configDir string, cacheOnly bool, httpClientFunc HTTPClientFunc) {
 	for i := range c.Rules {
-		rule := &c.Rules[i]
-
-		externalRule := &RuleBaseConfig{}
-		if rule.ExternalRule != "" {
-			var err error
-			externalRule, err = c.loadExternalRuleFile(rule.ExternalRule, configDir, cacheOnly, httpClientFunc)
-			if err != nil {
-				logger.Warn("Failed to load external rule file from %s: %v", rule.ExternalRule, err)
-			}
-		}
-
-		parsedIps := parseStringToList(strings.TrimSpace(rule.Ips+"\n"+externalRule.Ips), false)
-		parsedHosts := parseStringToList(strings.TrimSpace(rule.Hosts+"\n"+externalRule.Hosts), true)
-		parsedURLs := parseStringToList(strings.TrimSpace(rule.URLs+"\n"+externalRule.URLs), false)
+		c.preParseRule(&c.Rules[i], configDir, cacheOnly, httpClientFunc)
+	}
 
-		type loadTask struct {
-			sources         []string
-			expandWildcards bool
-			result          *[]string
+	for _, profile := range c.Profiles {
+		for i := range profile.Rules {
+			c.preParseRule(&profile.Rules[i], configDir, cacheOnly, httpClientFunc)
 		}
+	}
+}
 
-		tasks := []loadTask{
-			{parseStringToList(strings.TrimSpace(rule.ExternalIps+"\n"+externalRule.ExternalIps), false), false, &parsedIps},
-			{parseStringToList(strings.TrimSpace(rule.ExternalHosts+"\n"+externalRule.ExternalHosts), false), true, &parsedHosts},
-			{parseStringToList(strings.TrimSpace(rule.ExternalURLs+"\n"+externalRule.ExternalURLs), false), false, &parsedURLs},
+func (c *ProxyConfig) preParseRule(rule *RuleConfig, configDir string, cacheOnly bool, httpClientFunc HTTPClientFunc) {
+	externalRule := &RuleBaseConfig{}
+	if rule.ExternalRule != "" {
+		var err error
+		externalRule, err = c.loadExternalRuleFile(rule.ExternalRule, configDir, cacheOnly, httpClientFunc)
+		if err != nil {
+			logger.Warn("Failed to load external rule file from %s: %v", rule.ExternalRule, err)
 		}
+	}
 
-		var wg sync.WaitGroup
-		var mu sync.Mutex
-
-		for _, task := range tasks {
-			for _, source := range task.sources {
-				if source == "" {
-					continue
-				}
-
-				wg.Add(1)
-				go func(source string, expandWildcards bool, result *[]string) {
-					defer wg.Done()
-					rules := c.loadExternalRuleList(source, expandWildcards, configDir, cacheOnly, httpClientFunc)
-					mu.Lock()
-					*result = append(*result, rules...)
-					mu.Unlock()
-				}(source, task.expandWildcards, task.result)
-			}
-		}
+	parsedIps := parseStringToList(strings.TrimSpace(rule.Ips+"\n"+externalRule.Ips), false)
+	parsedHosts := parseStringToList(strings.TrimSpace(rule.Hosts+"\n"+externalRule.Hosts), true)
+	parsedURLs := parseStringToList(strings.TrimSpace(rule.URLs+"\n"+externalRule.URLs), false)
+	parsedUsers := parseStringToList(strings.TrimSpace(rule.Users+"\n"+externalRule.Users), false)
+	parsedSourceIps := parseStringToList(strings.TrimSpace(rule.SourceIps+"\n"+externalRule.SourceIps), false)
 
-		wg.Wait()
+	type loadTask struct {
+		sources         []string
+		expandWildcards bool
+		result          *[]string
+	}
+
+	tasks := []loadTask{
+		{parseStringToList(strings.TrimSpace(rule.ExternalIps+"\n"+externalRule.ExternalIps), false), false, &parsedIps},
+		{parseStringToList(strings.TrimSpace(rule.ExternalHosts+"\n"+externalRule.ExternalHosts), false), true, &parsedHosts},
+		{parseStringToList(strings.TrimSpace(rule.ExternalURLs+"\n"+externalRule.ExternalURLs), false), false, &parsedURLs},
+	}
 
-		if rule.Name == "" && externalRule.Name != "" {
-			rule.Name = externalRule.Name
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for _, task := range tasks {
+		for _, source := range task.sources {
+			if source == "" {
+				continue
+			}
+
+			wg.Add(1)
+			go func(source string, expandWildcards bool, result *[]string) {
+				defer wg.Done()
+				rules := c.loadExternalRuleList(source, expandWildcards, configDir, cacheOnly, httpClientFunc)
+				mu.Lock()
+				*result = append(*result, rules...)
+				mu.Unlock()
+			}(source, task.expandWildcards, task.result)
 		}
+	}
 
-		rule.parsedHosts = parsedHosts
-		rule.parsedIps = parsedIps
-		rule.parsedURLs = parsedURLs
+	wg.Wait()
+
+	if rule.Name == "" && externalRule.Name != "" {
+		rule.Name = externalRule.Name
 	}
+
+	rule.parsedHosts = parsedHosts
+	rule.parsedIps = parsedIps
+	rule.parsedURLs = parsedURLs
+	rule.parsedUsers = parsedUsers
+	rule.parsedSourceIps = parsedSourceIps
 }
 
 func (c *ProxyConfig) loadExternalRuleFile(source string, configDir string, cacheOnly bool, httpClientFunc HTTPClientFunc) (*RuleBaseConfig, error) {
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"goProxy/logger"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultCooldown         = 30 * time.Second
+	defaultConnectTimeout   = 10 * time.Second
+	defaultHandshakeTimeout = 10 * time.Second
+)
+
+func NewProxyEntry(urls ...string) *ProxyEntry {
+	return &ProxyEntry{URLs: urls}
+}
+
+func (p *ProxyEntry) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		var proxyURL string
+		if err := value.Decode(&proxyURL); err != nil {
+			return err
+		}
+		*p = ProxyEntry{URLs: []string{proxyURL}}
+	case yaml.SequenceNode:
+		var urls []string
+		if err := value.Decode(&urls); err != nil {
+			return err
+		}
+		*p = ProxyEntry{URLs: urls}
+	case yaml.MappingNode:
+		type plain ProxyEntry
+		var entry plain
+		if err := value.Decode(&entry); err != nil {
+			return err
+		}
+		*p = ProxyEntry(entry)
+	default:
+		return fmt.Errorf("line %d: proxy must be a URL, a list of URLs or a mapping", value.Line)
+	}
+	return nil
+}
+
+func (p ProxyEntry) MarshalYAML() (interface{}, error) {
+	if !p.hasOptions() {
+		if len(p.URLs) == 1 {
+			return p.URLs[0], nil
+		}
+		return p.URLs, nil
+	}
+	type plain ProxyEntry
+	return plain(p), nil
+}
+
+func (p *ProxyEntry) hasOptions() bool {
+	return p.Type != "" || p.CooldownSeconds != 0 || p.TLS != nil || p.Resolve != "" || p.Timeouts != nil || p.Bind != "" || p.ForwardHTTP
+}
+
+// IsDirect reports whether the entry connects directly over the default route.
+func (p *ProxyEntry) IsDirect() bool {
+	return (len(p.URLs) == 0 || (len(p.URLs) == 1 && p.URLs[0] == "")) && p.Bind == ""
+}
+
+func (p *ProxyEntry) IsBlock() bool {
+	return len(p.URLs) == 1 && p.URLs[0] == "#"
+}
+
+func (p *ProxyEntry) IsGroup() bool {
+	return len(p.URLs) > 1
+}
+
+func (p *ProxyEntry) IsFastest() bool {
+	return p.Type == "fastest"
+}
+
+func (p *ProxyEntry) GetCooldown() time.Duration {
+	if p.CooldownSeconds <= 0 {
+		return defaultCooldown
+	}
+	return time.Duration(p.CooldownSeconds) * time.Second
+}
+
+// ResolvesLocally reports whether target hostnames should be resolved before
+// being sent to a SOCKS hop with the given scheme. socks5 and socks4 resolve
+// locally, socks5h and socks4a let the server resolve, unless overridden.
+func (p *ProxyEntry) ResolvesLocally(scheme string) bool {
+	switch p.Resolve {
+	case "local":
+		return true
+	case "remote":
+		return false
+	}
+	return scheme == "socks5" || scheme == "socks4"
+}
+
+func (p *ProxyEntry) GetConnectTimeout() time.Duration {
+	return p.connectTimeout
+}
+
+func (p *ProxyEntry) GetHandshakeTimeout() time.Duration {
+	return p.handshakeTimeout
+}
+
+// GetIdleTimeout returns how long an upstream connection may go without
+// reads or writes before it is closed, or 0 when idle connections are kept.
+func (p *ProxyEntry) GetIdleTimeout() time.Duration {
+	return p.idleTimeout
+}
+
+// timeoutSeconds returns the per-proxy value if set, then the global one,
+// then the default.
+func timeoutSeconds(entry, global int, defaultTimeout time.Duration) time.Duration {
+	if entry > 0 {
+		return time.Duration(entry) * time.Second
+	}
+	if global > 0 {
+		return time.Duration(global) * time.Second
+	}
+	return defaultTimeout
+}
+
+func (p *ProxyEntry) applyTimeouts(global TimeoutConfig) {
+	entry := TimeoutConfig{}
+	if p.Timeouts != nil {
+		entry = *p.Timeouts
+	}
+	p.connectTimeout = timeoutSeconds(entry.ConnectSeconds, global.ConnectSeconds, defaultConnectTimeout)
+	p.handshakeTimeout = timeoutSeconds(entry.HandshakeSeconds, global.HandshakeSeconds, defaultHandshakeTimeout)
+	p.idleTimeout = timeoutSeconds(entry.IdleSeconds, global.IdleSeconds, 0)
+}
+
+// GetTLSConfig returns the TLS client configuration for https:// upstreams
+// of this entry, or nil when the defaults should be used.
+func (p *ProxyEntry) GetTLSConfig() *tls.Config {
+	return p.tlsConfig
+}
+
+// GetTLSError returns why the tls settings of the entry could not be loaded,
+// or nil. Such an entry must not be dialled, rather than falling back to the
+// default TLS settings.
+func (p *ProxyEntry) GetTLSError() error {
+	return p.tlsErr
+}
+
+func (t *ProxyTLSConfig) load(configDir string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(resolvePath(t.CAFile, configDir))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(resolvePath(t.CertFile, configDir), resolvePath(t.KeyFile, configDir))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (c *ProxyConfig) prepareProxies() {
+	configDir := filepath.Dir(c.configPath)
+
+	for name, entry := range c.Proxies {
+		if entry == nil || len(entry.URLs) == 0 {
+			logger.Warn("Proxy '%s' has no URLs, treating it as direct", name)
+			entry = NewProxyEntry("")
+			c.Proxies[name] = entry
+		}
+		entry.applyTimeouts(c.Timeouts)
+		if entry.Type != "" && entry.Type != "failover" && entry.Type != "fastest" {
+			logger.Warn("Proxy '%s' has unknown type '%s', using failover", name, entry.Type)
+		}
+		if entry.Resolve != "" && entry.Resolve != "local" && entry.Resolve != "remote" {
+			logger.Warn("Proxy '%s' has unknown resolve mode '%s', using the scheme default", name, entry.Resolve)
+		}
+		if entry.TLS != nil {
+			tlsConfig, err := entry.TLS.load(configDir)
+			if err != nil {
+				logger.Error("Proxy '%s' has invalid TLS settings, refusing connections through it: %v", name, err)
+				entry.tlsErr = fmt.Errorf("invalid TLS settings of proxy '%s': %w", name, err)
+			} else {
+				entry.tlsConfig = tlsConfig
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestProxyEntryYAML(t *testing.T) {
+	cfg := loadTestConfig(t, `
+defaultProxy: single
+proxies:
+  single: "http://a:3128"
+  group:
+    - "http://a:3128"
+    - "socks5://b:1080"
+  options:
+    urls: ["http://a:3128", "http://b:3128"]
+    cooldownSeconds: 5
+  empty:
+rules: []
+`)
+
+	tests := []struct {
+		name     string
+		urls     []string
+		group    bool
+		cooldown time.Duration
+	}{
+		{"single", []string{"http://a:3128"}, false, defaultCooldown},
+		{"group", []string{"http://a:3128", "socks5://b:1080"}, true, defaultCooldown},
+		{"options", []string{"http://a:3128", "http://b:3128"}, true, 5 * time.Second},
+		{"empty", []string{""}, false, defaultCooldown},
+	}
+	for _, tt := range tests {
+		entry := cfg.Proxies[tt.name]
+		if entry == nil {
+			t.Errorf("proxy '%s' is missing", tt.name)
+			continue
+		}
+		if !reflect.DeepEqual(entry.URLs, tt.urls) || entry.IsGroup() != tt.group || entry.GetCooldown() != tt.cooldown {
+			t.Errorf("proxy '%s' = %v, group %v, cooldown %v", tt.name, entry.URLs, entry.IsGroup(), entry.GetCooldown())
+		}
+	}
+	if !cfg.Proxies["empty"].IsDirect() {
+		t.Error("proxy without URLs is not direct")
+	}
+}
+
+func TestProxyEntryMarshalKeepsShortForms(t *testing.T) {
+	tests := []struct {
+		entry *ProxyEntry
+		want  string
+	}{
+		{NewProxyEntry("http://a:3128"), "http://a:3128\n"},
+		{NewProxyEntry("http://a:3128", "http://b:3128"), "- http://a:3128\n- http://b:3128\n"},
+		{&ProxyEntry{URLs: []string{"http://a:3128"}, CooldownSeconds: 5}, "urls:\n    - http://a:3128\ncooldownSeconds: 5\n"},
+	}
+	for _, tt := range tests {
+		out, err := yaml.Marshal(tt.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("Marshal(%v) = %q, want %q", tt.entry.URLs, out, tt.want)
+		}
+	}
+}
+
+func TestProxyEntryResolvesLocally(t *testing.T) {
+	tests := []struct {
+		resolve string
+		scheme  string
+		want    bool
+	}{
+		{"", "socks5", true},
+		{"", "socks5h", false},
+		{"", "socks4", true},
+		{"", "socks4a", false},
+		{"local", "socks5h", true},
+		{"remote", "socks5", false},
+		{"unknown", "socks5", true},
+	}
+	for _, tt := range tests {
+		entry := &ProxyEntry{Resolve: tt.resolve}
+		if got := entry.ResolvesLocally(tt.scheme); got != tt.want {
+			t.Errorf("resolve %q, %s: ResolvesLocally() = %v, want %v", tt.resolve, tt.scheme, got, tt.want)
+		}
+	}
+}
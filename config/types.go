@@ -1,8 +1,11 @@
 package config
 
 import (
+	"crypto/tls"
 	"goProxy/cache"
+	"net"
 	"net/http"
+	"time"
 )
 
 type HTTPClientFunc func(string) (*http.Client, error)
@@ -21,14 +24,18 @@ type RuleBaseConfig struct {
 	Ips           string `yaml:"ips,omitempty"`
 	Hosts         string `yaml:"hosts,omitempty"`
 	URLs          string `yaml:"urls,omitempty"`
+	Users         string `yaml:"users,omitempty"`
+	SourceIps     string `yaml:"sourceIps,omitempty"`
 	ExternalIps   string `yaml:"externalIps,omitempty"`
 	ExternalHosts string `yaml:"externalHosts,omitempty"`
 	ExternalURLs  string `yaml:"externalURLs,omitempty"`
 	ExternalRule  string `yaml:"externalRule,omitempty"`
 
-	parsedIps   []string
-	parsedHosts []string
-	parsedURLs  []string
+	parsedIps       []string
+	parsedHosts     []string
+	parsedURLs      []string
+	parsedUsers     []string
+	parsedSourceIps []string
 }
 
 type RuleConfig struct {
@@ -37,18 +44,138 @@ type RuleConfig struct {
 	Not            bool   `yaml:"not,omitempty"`
 }
 
+// ProxyEntry is a named upstream. It is written in YAML either as a single
+// URL, as a list of URLs forming a failover group, or as a mapping with options.
+type ProxyEntry struct {
+	URLs            []string        `yaml:"urls"`
+	Type            string          `yaml:"type,omitempty"`
+	CooldownSeconds int             `yaml:"cooldownSeconds,omitempty"`
+	TLS             *ProxyTLSConfig `yaml:"tls,omitempty"`
+	Resolve         string          `yaml:"resolve,omitempty"`
+	Timeouts        *TimeoutConfig  `yaml:"timeouts,omitempty"`
+	Bind            string          `yaml:"bind,omitempty"`
+	ForwardHTTP     bool            `yaml:"forwardHTTP,omitempty"`
+
+	tlsConfig        *tls.Config
+	tlsErr           error
+	connectTimeout   time.Duration
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+}
+
+// ProxyTLSConfig configures the TLS handshake with https:// upstreams.
+// Relative file paths are resolved against the config directory.
+type ProxyTLSConfig struct {
+	CAFile             string `yaml:"caFile,omitempty"`
+	ServerName         string `yaml:"serverName,omitempty"`
+	CertFile           string `yaml:"certFile,omitempty"`
+	KeyFile            string `yaml:"keyFile,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+}
+
+// TimeoutConfig bounds upstream connections: the TCP connect, the protocol
+// handshake of every proxy hop and the time a connection may stay idle.
+type TimeoutConfig struct {
+	ConnectSeconds   int `yaml:"connectSeconds,omitempty"`
+	HandshakeSeconds int `yaml:"handshakeSeconds,omitempty"`
+	IdleSeconds      int `yaml:"idleSeconds,omitempty"`
+}
+
+type HealthCheckConfig struct {
+	Target          string `yaml:"target,omitempty"`
+	IntervalSeconds int    `yaml:"intervalSeconds,omitempty"`
+	TimeoutSeconds  int    `yaml:"timeoutSeconds,omitempty"`
+}
+
+// ListenerConfig is an inbound endpoint. It routes with the main rules unless
+// it selects a rule profile or forces every connection through one proxy.
+type ListenerConfig struct {
+	Name     string `yaml:"name,omitempty"`
+	Addr     string `yaml:"addr"`
+	Protocol string `yaml:"protocol,omitempty"`
+	Profile  string `yaml:"profile,omitempty"`
+	Proxy    string `yaml:"proxy,omitempty"`
+
+	SocketMode  string `yaml:"socketMode,omitempty"`
+	SocketOwner string `yaml:"socketOwner,omitempty"`
+
+	TLS *ListenerTLSConfig `yaml:"tls,omitempty"`
+}
+
+// ListenerTLSConfig makes a listener accept TLS, so that clients reach it as
+// an https:// proxy. Relative paths are resolved against the config directory.
+type ListenerTLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	certificate *tls.Certificate
+	loadErr     error
+}
+
+// DNSConfig selects the resolvers used for IP rules, direct connections and
+// the DNS listener instead of the system resolver.
+type DNSConfig struct {
+	Servers   []string          `yaml:"servers,omitempty"`
+	Overrides map[string]string `yaml:"overrides,omitempty"`
+	Proxy     string            `yaml:"proxy,omitempty"`
+
+	MinTTLSeconds      int `yaml:"minTTLSeconds,omitempty"`
+	MaxTTLSeconds      int `yaml:"maxTTLSeconds,omitempty"`
+	NegativeTTLSeconds int `yaml:"negativeTTLSeconds,omitempty"`
+}
+
+// FakeIPConfig makes the DNS listener answer A queries with addresses from a
+// reserved range, which inbound connections are mapped back to names from.
+type FakeIPConfig struct {
+	Range   string `yaml:"range,omitempty"`
+	Size    int    `yaml:"size,omitempty"`
+	Exclude string `yaml:"exclude,omitempty"`
+	Persist bool   `yaml:"persist,omitempty"`
+}
+
+// RuleProfile is an alternative rule set that listeners can select.
+type RuleProfile struct {
+	DefaultProxy string       `yaml:"defaultProxy,omitempty"`
+	Rules        []RuleConfig `yaml:"rules"`
+}
+
 type ProxyConfig struct {
-	DefaultProxy    string            `yaml:"defaultProxy"`
-	Proxies         map[string]string `yaml:"proxies"`
-	ListenAddr      string            `yaml:"listenAddr"`
-	LogLevel        string            `yaml:"logLevel"`
-	LogFile         string            `yaml:"logFile,omitempty"`
-	MaxLogSize      int               `yaml:"maxLogSize,omitempty"`
-	MaxLogFiles     int               `yaml:"maxLogFiles,omitempty"`
-	AutoReloadHours int               `yaml:"autoReloadHours,omitempty"`
-	Rules           []RuleConfig      `yaml:"rules"`
-
-	logLevelInt int
-	cache       *cache.CacheManager
-	configPath  string
+	DefaultProxy     string                  `yaml:"defaultProxy"`
+	Proxies          map[string]*ProxyEntry  `yaml:"proxies"`
+	ListenAddr       string                  `yaml:"listenAddr"`
+	SocksListenAddr  string                  `yaml:"socksListenAddr,omitempty"`
+	LegacySocksUsers map[string]string       `yaml:"socksUsers,omitempty"`
+	AuthFile         string                  `yaml:"authFile,omitempty"`
+	AllowClients     []string                `yaml:"allowClients,omitempty"`
+	DenyClients      []string                `yaml:"denyClients,omitempty"`
+	DNS              *DNSConfig              `yaml:"dns,omitempty"`
+	Hosts            map[string]string       `yaml:"hosts,omitempty"`
+	HostsFile        string                  `yaml:"hostsFile,omitempty"`
+	DNSListenAddr    string                  `yaml:"dnsListenAddr,omitempty"`
+	DNSUpstream      string                  `yaml:"dnsUpstream,omitempty"`
+	DNSBlockResponse string                  `yaml:"dnsBlockResponse,omitempty"`
+	FakeIP           *FakeIPConfig           `yaml:"fakeIP,omitempty"`
+	Listeners        []ListenerConfig        `yaml:"listeners,omitempty"`
+	SocketMode       string                  `yaml:"socketMode,omitempty"`
+	SocketOwner      string                  `yaml:"socketOwner,omitempty"`
+	ListenTLS        *ListenerTLSConfig      `yaml:"listenTLS,omitempty"`
+	Profiles         map[string]*RuleProfile `yaml:"profiles,omitempty"`
+	LogLevel         string                  `yaml:"logLevel"`
+	LogFile          string                  `yaml:"logFile,omitempty"`
+	MaxLogSize       int                     `yaml:"maxLogSize,omitempty"`
+	MaxLogFiles      int                     `yaml:"maxLogFiles,omitempty"`
+	AutoReloadHours  int                     `yaml:"autoReloadHours,omitempty"`
+	HealthCheck      HealthCheckConfig       `yaml:"healthCheck,omitempty"`
+	Timeouts         TimeoutConfig           `yaml:"timeouts,omitempty"`
+	Rules            []RuleConfig            `yaml:"rules"`
+
+	logLevelInt   int
+	authUsers     map[string]string
+	dnsUpstream   string
+	dnsServers    []string
+	staticHosts   map[string][]net.IP
+	fakeIPRange   *net.IPNet
+	fakeIPExclude []string
+	cache         *cache.CacheManager
+	configPath    string
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func parseLogLevel(level string) int {
@@ -31,7 +32,7 @@ func (c *ProxyConfig) ShouldLog(level int) bool {
 
 func (c *ProxyConfig) GetAllIps() []string {
 	var allIPs []string
-	for _, rule := range c.Rules {
+	for _, rule := range c.allRules() {
 		allIPs = append(allIPs, rule.parsedIps...)
 	}
 	return allIPs
@@ -39,7 +40,7 @@ func (c *ProxyConfig) GetAllIps() []string {
 
 func (c *ProxyConfig) GetAllHosts() []string {
 	var allHosts []string
-	for _, rule := range c.Rules {
+	for _, rule := range c.allRules() {
 		allHosts = append(allHosts, rule.parsedHosts...)
 	}
 	return allHosts
@@ -47,7 +48,7 @@ func (c *ProxyConfig) GetAllHosts() []string {
 
 func (c *ProxyConfig) GetAllURLs() []string {
 	var allURLs []string
-	for _, rule := range c.Rules {
+	for _, rule := range c.allRules() {
 		allURLs = append(allURLs, rule.parsedURLs...)
 	}
 	return allURLs
@@ -65,6 +66,14 @@ func (r *RuleConfig) GetParsedURLs() []string {
 	return r.parsedURLs
 }
 
+func (r *RuleConfig) GetParsedUsers() []string {
+	return r.parsedUsers
+}
+
+func (r *RuleConfig) GetParsedSourceIps() []string {
+	return r.parsedSourceIps
+}
+
 func (c *ProxyConfig) GetAccessLogPath() string {
 	if c.LogFile == "" {
 		return ""
@@ -92,6 +101,45 @@ func (c *ProxyConfig) GetMaxLogFiles() int {
 	return c.MaxLogFiles
 }
 
+func (c *ProxyConfig) GetHealthCheckTarget() string {
+	if c.HealthCheck.Target == "" {
+		return "www.gstatic.com:443"
+	}
+	return c.HealthCheck.Target
+}
+
+func (c *ProxyConfig) GetHealthCheckInterval() time.Duration {
+	if c.HealthCheck.IntervalSeconds <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(c.HealthCheck.IntervalSeconds) * time.Second
+}
+
+func (c *ProxyConfig) GetHealthCheckTimeout() time.Duration {
+	if c.HealthCheck.TimeoutSeconds <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.HealthCheck.TimeoutSeconds) * time.Second
+}
+
+// GetHandshakeTimeout returns how long inbound clients may take to complete
+// the protocol handshake.
+func (c *ProxyConfig) GetHandshakeTimeout() time.Duration {
+	return timeoutSeconds(0, c.Timeouts.HandshakeSeconds, defaultHandshakeTimeout)
+}
+
+// resolvePath makes a relative path absolute against baseDir, or against the
+// profile directory when baseDir is empty.
+func resolvePath(path string, baseDir string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if baseDir != "" {
+		return filepath.Join(baseDir, path)
+	}
+	return filepath.Join(getProfilePath(), path)
+}
+
 func loadExternalRules(source string, baseDir string, cacheOnly bool, httpClientFunc HTTPClientFunc) (string, error) {
 	var filePath string
 	var err error
@@ -102,16 +150,7 @@ func loadExternalRules(source string, baseDir string, cacheOnly bool, httpClient
 			return "", err
 		}
 	} else {
-		filePath = source
-
-		if !filepath.IsAbs(filePath) {
-			if baseDir != "" {
-				filePath = filepath.Join(baseDir, filePath)
-			} else {
-				profileDir := getProfilePath()
-				filePath = filepath.Join(profileDir, filePath)
-			}
-		}
+		filePath = resolvePath(source, baseDir)
 
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			return "", fmt.Errorf("local file not found: %s", filePath)
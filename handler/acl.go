@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+
+	"goProxy/cache"
+	"goProxy/config"
+	"goProxy/logger"
+)
+
+// clientACL decides which inbound clients are served, by their source IP.
+type clientACL struct {
+	restricted bool
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+}
+
+func newClientACL(config *config.ProxyConfig, cacheManager *cache.CacheManager) *clientACL {
+	acl := &clientACL{
+		restricted: len(config.AllowClients) > 0,
+		allow:      parseClientNets("allowClients", config.AllowClients, cacheManager),
+		deny:       parseClientNets("denyClients", config.DenyClients, cacheManager),
+	}
+	if acl.restricted && len(acl.allow) == 0 {
+		logger.Error("No valid allowClients entry, rejecting all clients")
+	}
+	return acl
+}
+
+func parseClientNets(field string, cidrs []string, cacheManager *cache.CacheManager) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		ipNet, err := cacheManager.GetCIDRNet(cidr)
+		if err != nil {
+			logger.Warn("Ignoring invalid %s entry '%s': %v", field, cidr, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// allows reports whether a client may use the proxy. Clients without an IP,
+// such as those of unix socket listeners, are always allowed; the socket
+// permissions control their access.
+func (a *clientACL) allows(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return !a.restricted || containsIP(a.allow, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP of a remote address, or nil when it has none.
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// requestIP returns the client IP of an HTTP request, or nil when it has none.
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientACL(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		ip     net.IP
+		want   bool
+	}{
+		{"no lists", "", net.ParseIP("192.0.2.1"), true},
+		{"allowed", "allowClients: [\"192.0.2.0/24\"]", net.ParseIP("192.0.2.1"), true},
+		{"not allowed", "allowClients: [\"192.0.2.0/24\"]", net.ParseIP("198.51.100.1"), false},
+		{"denied before allowed", "allowClients: [\"192.0.2.0/24\"]\ndenyClients: [\"192.0.2.7\"]", net.ParseIP("192.0.2.7"), false},
+		{"denied", "denyClients: [\"2001:db8::/32\"]", net.ParseIP("2001:db8::1"), false},
+		{"invalid entry skipped", "allowClients: [\"192.0.2.0/33\", \"192.0.2.0/24\"]", net.ParseIP("192.0.2.1"), true},
+		{"no valid entry", "allowClients: [\"192.0.2.0/33\"]", net.ParseIP("192.0.2.1"), false},
+		{"unix socket client", "allowClients: [\"192.0.2.0/24\"]", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestHandler(t, "defaultProxy: direct\n"+tt.config+"\nrules: []\n")
+			if got := handler.acl.allows(tt.ip); got != tt.want {
+				t.Errorf("allows(%v) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientACLRefusesHTTPClients(t *testing.T) {
+	handler := newTestHandler(t, `
+defaultProxy: direct
+allowClients: ["192.0.2.0/24"]
+rules: []
+`)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.RemoteAddr = "198.51.100.1:40000"
+	handler.ListenerHandler("").ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("got %d, want 403", recorder.Code)
+	}
+}
+
+func TestClientRules(t *testing.T) {
+	handler := newTestHandler(t, `
+defaultProxy: direct
+rules:
+  - sourceIps: "10.0.0.0/8"
+    hosts: "*.example"
+    proxy: block
+  - users: "alice"
+    proxy: block
+  - sourceIps: "192.0.2.0/24"
+    not: true
+    hosts: "allowed.example"
+    proxy: block
+`)
+	decision := handler.decisionFor("")
+
+	tests := []struct {
+		name   string
+		addr   string
+		client clientInfo
+		want   string
+	}{
+		{"source and host", "a.example:443", clientInfo{ip: net.ParseIP("10.1.2.3")}, "block"},
+		{"host from another source", "a.example:443", clientInfo{ip: net.ParseIP("172.16.0.1")}, "direct"},
+		{"user only", "other.test:443", clientInfo{user: "alice", ip: net.ParseIP("172.16.0.1")}, "block"},
+		{"other user", "other.test:443", clientInfo{user: "bob", ip: net.ParseIP("172.16.0.1")}, "direct"},
+		{"inverted hosts of a source", "other.test:443", clientInfo{ip: net.ParseIP("192.0.2.1")}, "block"},
+		{"allowed host of a source", "allowed.example:443", clientInfo{ip: net.ParseIP("192.0.2.1")}, "direct"},
+		{"client without IP", "a.example:443", clientInfo{}, "direct"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, result, err := decision.GetProxyForAddr(tt.addr, tt.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Proxy != tt.want {
+				t.Errorf("proxy = %s (rule '%s'), want %s", result.Proxy, result.RuleName, tt.want)
+			}
+		})
+	}
+}
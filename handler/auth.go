@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"goProxy/config"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const userContextKey contextKey = "user"
+
+// authenticator checks the credentials of inbound clients against the auth
+// file. Successful checks are remembered so that bcrypt hashes are not
+// recomputed for every request of a client.
+type authenticator struct {
+	required bool
+	hashes   map[string]string
+	verified *lru.Cache[[sha256.Size]byte, bool]
+}
+
+func newAuthenticator(config *config.ProxyConfig) *authenticator {
+	verified, _ := lru.New[[sha256.Size]byte, bool](1000)
+	return &authenticator{
+		required: config.AuthRequired(),
+		hashes:   config.GetAuthUsers(),
+		verified: verified,
+	}
+}
+
+func (a *authenticator) check(username, password string) bool {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	if _, exists := a.verified.Get(key); exists {
+		return true
+	}
+
+	hash, exists := a.hashes[username]
+	if !exists || !verifyHash(hash, password) {
+		return false
+	}
+
+	a.verified.Add(key, true)
+	return true
+}
+
+// authenticateRequest returns the user named in the Proxy-Authorization
+// header, and false when authentication is required but failed.
+func (a *authenticator) authenticateRequest(r *http.Request) (string, bool) {
+	if !a.required {
+		return "", true
+	}
+
+	username, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if !ok || !a.check(username, password) {
+		return username, false
+	}
+	return username, true
+}
+
+func parseProxyAuthorization(header string) (username, password string, ok bool) {
+	scheme, credentials, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+// verifyHash checks a password against a bcrypt or {SHA} htpasswd hash.
+func verifyHash(hash, password string) bool {
+	if encoded, found := strings.CutPrefix(hash, "{SHA}"); found {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(encoded), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func requireProxyAuth(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", `Basic realm="goProxy"`)
+	http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+}
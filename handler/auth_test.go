@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hash, password string
+		want           bool
+	}{
+		{string(bcryptHash), "secret", true},
+		{string(bcryptHash), "guess", false},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", true},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "Password", false},
+	}
+	for _, tt := range tests {
+		if got := verifyHash(tt.hash, tt.password); got != tt.want {
+			t.Errorf("verifyHash(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestParseProxyAuthorization(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("alice:pass:word"))
+	tests := []struct {
+		header, username, password string
+		ok                         bool
+	}{
+		{"Basic " + encoded, "alice", "pass:word", true},
+		{"basic " + encoded, "alice", "pass:word", true},
+		{"Bearer " + encoded, "", "", false},
+		{"Basic not-base64!", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		username, password, ok := parseProxyAuthorization(tt.header)
+		if username != tt.username || password != tt.password || ok != tt.ok {
+			t.Errorf("parseProxyAuthorization(%q) = %q, %q, %v", tt.header, username, password, ok)
+		}
+	}
+}
+
+// TestProxyAuthentication sends requests through an HTTP listener that
+// requires users from an htpasswd file and routes one of them elsewhere.
+func TestProxyAuthentication(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "target")
+	}))
+	defer target.Close()
+
+	authFile := filepath.Join(t.TempDir(), "htpasswd")
+	htpasswd := "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	if err := os.WriteFile(authFile, []byte(htpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: direct
+authFile: %q
+rules:
+  - users: "bob"
+    proxy: block
+`, authFile))
+	proxy := httptest.NewServer(handler.ListenerHandler(""))
+	defer proxy.Close()
+
+	tests := []struct {
+		name string
+		user *url.Userinfo
+		want int
+	}{
+		{"no credentials", nil, http.StatusProxyAuthRequired},
+		{"wrong password", url.UserPassword("alice", "guess"), http.StatusProxyAuthRequired},
+		{"valid user", url.UserPassword("alice", "password"), http.StatusOK},
+		{"user routed by a rule", url.UserPassword("bob", "password"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL, _ := url.Parse(proxy.URL)
+			proxyURL.User = tt.user
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			response, err := client.Get(target.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+
+			if response.StatusCode != tt.want {
+				t.Errorf("got %s, want %d", response.Status, tt.want)
+			}
+			if tt.want == http.StatusProxyAuthRequired && response.Header.Get("Proxy-Authenticate") == "" {
+				t.Error("407 without a Proxy-Authenticate challenge")
+			}
+		})
+	}
+}
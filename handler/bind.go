@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// directBindPrefix marks a direct connection bound to a local source, as in
+// "direct@tun0" or "direct@192.168.1.10".
+const directBindPrefix = "direct@"
+
+// splitDirectBind returns the bind target of a "direct@..." upstream URL.
+func splitDirectBind(proxyURL string) (bind string, ok bool) {
+	if !strings.HasPrefix(proxyURL, directBindPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(proxyURL, directBindPrefix), true
+}
+
+// applyBind makes the dialer use the given local IP address or network
+// interface as the source of its connections. Interface addresses are looked
+// up on every dial so that VPN reconnects are picked up.
+func applyBind(dialer *net.Dialer, bind string) error {
+	if bind == "" {
+		return nil
+	}
+
+	if ip := net.ParseIP(bind); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		return nil
+	}
+
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return fmt.Errorf("bind interface %s: %w", bind, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return fmt.Errorf("bind interface %s: %w", bind, err)
+	}
+
+	var ip net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			ip = ipNet.IP
+			break
+		}
+		if ip == nil {
+			ip = ipNet.IP
+		}
+	}
+	if ip == nil {
+		return fmt.Errorf("bind interface %s has no usable address", bind)
+	}
+
+	dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	dialer.Control = bindToDeviceControl(iface.Name)
+	return nil
+}
+
+// listenUDPBound opens a UDP socket for outgoing datagrams, bound like
+// applyBind binds TCP connections.
+func listenUDPBound(bind string) (*net.UDPConn, error) {
+	dialer := &net.Dialer{}
+	if err := applyBind(dialer, bind); err != nil {
+		return nil, err
+	}
+
+	localAddr := ""
+	if tcpAddr, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		localAddr = net.JoinHostPort(tcpAddr.IP.String(), "0")
+	}
+
+	listenConfig := net.ListenConfig{Control: dialer.Control}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package handler
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDeviceControl pins sockets to the interface with SO_BINDTODEVICE so
+// that traffic leaves through it regardless of the routing table. Without
+// CAP_NET_RAW the option is refused and only the source address binding applies.
+func bindToDeviceControl(ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifaceName)
+		})
+		if err != nil {
+			return err
+		}
+		if opErr != nil && !errors.Is(opErr, syscall.EPERM) {
+			return opErr
+		}
+		return nil
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package handler
+
+import "syscall"
+
+// bindToDeviceControl is a no-op outside Linux, where binding to the
+// interface address is what selects the interface.
+func bindToDeviceControl(ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestSplitDirectBind(t *testing.T) {
+	tests := []struct {
+		proxyURL string
+		bind     string
+		ok       bool
+	}{
+		{"direct@tun0", "tun0", true},
+		{"direct@192.168.1.10", "192.168.1.10", true},
+		{"", "", false},
+		{"http://direct@a:3128", "", false},
+	}
+	for _, tt := range tests {
+		if bind, ok := splitDirectBind(tt.proxyURL); bind != tt.bind || ok != tt.ok {
+			t.Errorf("splitDirectBind(%q) = %q, %v, want %q, %v", tt.proxyURL, bind, ok, tt.bind, tt.ok)
+		}
+	}
+}
+
+// loopbackInterface returns the name of the loopback interface.
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestApplyBind(t *testing.T) {
+	dialer := &net.Dialer{}
+	if err := applyBind(dialer, "192.0.2.10"); err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := dialer.LocalAddr.(*net.TCPAddr); !ok || addr.IP.String() != "192.0.2.10" {
+		t.Errorf("LocalAddr = %v, want 192.0.2.10", dialer.LocalAddr)
+	}
+
+	dialer = &net.Dialer{}
+	if err := applyBind(dialer, loopbackInterface(t)); err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := dialer.LocalAddr.(*net.TCPAddr); !ok || !addr.IP.IsLoopback() {
+		t.Errorf("LocalAddr = %v, want a loopback address", dialer.LocalAddr)
+	}
+
+	if err := applyBind(&net.Dialer{}, "no-such-interface0"); err == nil {
+		t.Error("unknown interface accepted")
+	}
+}
+
+func TestDirectBind(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding 127.0.0.2 needs the Linux loopback network")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sources := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		conn.Close()
+	}()
+
+	handler := newTestHandler(t, `
+defaultProxy: bound
+proxies:
+  bound: "direct@127.0.0.2"
+rules: []
+`)
+	entry := handler.decision.config.Proxies["bound"]
+	conn, err := handler.dialUpstream(context.Background(), entry, entry.URLs[0], "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if source := <-sources; source != "127.0.0.2" {
+		t.Errorf("connection came from %s, want 127.0.0.2", source)
+	}
+
+	udpConn, err := listenUDPBound("127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	if addr := udpConn.LocalAddr().(*net.UDPAddr); addr.IP.String() != "127.0.0.2" {
+		t.Errorf("UDP socket bound to %s, want 127.0.0.2", addr)
+	}
+}
@@ -0,0 +1,391 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"goProxy/cache"
+	"goProxy/config"
+)
+
+const chainSeparator = "->"
+
+// contextDialer is implemented by every hop of an upstream chain.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dialUpstream connects to addr through a single upstream URL of the entry.
+// The URL may be a chain such as "socks5://bastion:1080 -> http://corp:3128",
+// in which case every hop is reached through the previous one, or a bound
+// direct connection such as "direct@tun0".
+func (p *ProxyHandler) dialUpstream(ctx context.Context, proxyEntry *config.ProxyEntry, proxyURL, network, addr string) (net.Conn, error) {
+	if proxyURL == "#" {
+		return nil, fmt.Errorf("connection blocked by proxy configuration")
+	}
+	if err := proxyEntry.GetTLSError(); err != nil {
+		return nil, err
+	}
+
+	bind := proxyEntry.Bind
+	if directBind, ok := splitDirectBind(proxyURL); ok {
+		bind = directBind
+		proxyURL = ""
+	}
+
+	baseDialer := &net.Dialer{Timeout: proxyEntry.GetConnectTimeout()}
+	if err := applyBind(baseDialer, bind); err != nil {
+		return nil, err
+	}
+
+	var dialer contextDialer = baseDialer
+
+	// Direct connections resolve their target with the pinned hosts and the
+	// configured DNS servers; proxies are still found through the system
+	// resolver.
+	if proxyURL == "" && (p.cache.HasResolver() || p.cache.HasStaticHosts()) {
+		dialer = &resolvingDialer{cache: p.cache, next: baseDialer, pinnedOnly: !p.cache.HasResolver()}
+	}
+
+	if proxyURL != "" {
+		hops, err := parseProxyChain(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+
+		// The tls settings are meant for the first https hop, the one the
+		// entry is configured for. Later ones are verified by their own name.
+		tlsConfig := proxyEntry.GetTLSConfig()
+		for _, hop := range hops {
+			dialer, err = p.newHopDialer(proxyEntry, hop, tlsConfig, dialer)
+			if err != nil {
+				return nil, err
+			}
+			if hop.Scheme == "https" && tlsConfig != nil && tlsConfig.ServerName != "" {
+				tlsConfig = tlsConfig.Clone()
+				tlsConfig.ServerName = ""
+			}
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		if proxyURL == "" && errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, &destinationError{err: err}
+		}
+		return nil, err
+	}
+
+	if idleTimeout := proxyEntry.GetIdleTimeout(); idleTimeout > 0 {
+		return &idleTimeoutConn{Conn: conn, timeout: idleTimeout}, nil
+	}
+
+	return conn, nil
+}
+
+func parseProxyChain(proxyURL string) ([]*url.URL, error) {
+	parts := strings.Split(proxyURL, chainSeparator)
+	hops := make([]*url.URL, 0, len(parts))
+	for _, part := range parts {
+		parsedURL, err := url.Parse(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing proxy URL: %w", err)
+		}
+		hops = append(hops, parsedURL)
+	}
+	return hops, nil
+}
+
+// newHopDialer returns a dialer that tunnels through the proxy at hopURL,
+// reaching that proxy via forward. tlsConfig is used for https hops.
+func (p *ProxyHandler) newHopDialer(proxyEntry *config.ProxyEntry, hopURL *url.URL, tlsConfig *tls.Config, forward contextDialer) (contextDialer, error) {
+	switch hopURL.Scheme {
+	case "socks5", "socks5h":
+		dialer := &socks5Dialer{
+			proxyURL:         hopURL,
+			handshakeTimeout: proxyEntry.GetHandshakeTimeout(),
+			forward:          forward,
+		}
+		if proxyEntry.ResolvesLocally(hopURL.Scheme) {
+			return &resolvingDialer{cache: p.cache, next: dialer}, nil
+		}
+		return dialer, nil
+	case "socks4", "socks4a":
+		return &socks4Dialer{
+			proxyURL:         hopURL,
+			resolveLocally:   proxyEntry.ResolvesLocally(hopURL.Scheme),
+			handshakeTimeout: proxyEntry.GetHandshakeTimeout(),
+			cache:            p.cache,
+			forward:          forward,
+		}, nil
+	case "http", "https":
+		return &httpConnectDialer{
+			proxyURL:         hopURL,
+			tlsConfig:        tlsConfig,
+			handshakeTimeout: proxyEntry.GetHandshakeTimeout(),
+			forward:          forward,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", hopURL.Scheme)
+	}
+}
+
+// runHandshake bounds a protocol exchange on conn by the handshake timeout
+// and aborts it as soon as ctx is cancelled.
+func runHandshake(ctx context.Context, conn net.Conn, timeout time.Duration, handshake func() error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	err := handshake()
+	close(stop)
+	<-stopped
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("handshake aborted: %w", ctxErr)
+		}
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// resolvingDialer resolves the target hostname through the DNS cache and
+// passes IP addresses to the next dialer, trying each address in turn. With
+// pinnedOnly, hostnames that are not pinned are passed on unresolved.
+type resolvingDialer struct {
+	cache      *cache.CacheManager
+	next       contextDialer
+	pinnedOnly bool
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.next.DialContext(ctx, network, addr)
+	}
+
+	ips, pinned := d.cache.StaticHost(host)
+	if !pinned {
+		if d.pinnedOnly {
+			return d.next.DialContext(ctx, network, addr)
+		}
+		var err error
+		ips, err = d.cache.ResolveHostContext(ctx, host)
+		if err != nil {
+			return nil, &destinationError{err: fmt.Errorf("error resolving %s: %w", host, err)}
+		}
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := d.next.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = &destinationError{err: fmt.Errorf("no addresses found for %s", host)}
+	}
+	return nil, lastErr
+}
+
+// httpConnectDialer opens tunnels with the HTTP CONNECT method.
+type httpConnectDialer struct {
+	proxyURL         *url.URL
+	tlsConfig        *tls.Config
+	handshakeTimeout time.Duration
+	forward          contextDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", proxyHostPort(d.proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to HTTP proxy: %w", upstreamError(err))
+	}
+
+	if d.proxyURL.Scheme == "https" {
+		conn, err = tlsClientHandshake(ctx, conn, d.proxyURL, d.tlsConfig, d.handshakeTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+
+	if d.proxyURL.User != nil {
+		username := d.proxyURL.User.Username()
+		password, _ := d.proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		connectReq += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+
+	connectReq += "\r\n"
+
+	reader := bufio.NewReader(conn)
+	err = runHandshake(ctx, conn, d.handshakeTimeout, func() error {
+		if _, err := conn.Write([]byte(connectReq)); err != nil {
+			return fmt.Errorf("error sending CONNECT request: %w", err)
+		}
+
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return fmt.Errorf("error reading proxy response: %w", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			err := fmt.Errorf("proxy CONNECT failed with status: %d %s", resp.StatusCode, resp.Status)
+			if connectStatusAboutDestination(resp.StatusCode) {
+				return &destinationError{err: err}
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// connectStatusAboutDestination reports whether a proxy refused a CONNECT
+// request because of the destination, rather than failing itself or asking
+// for credentials.
+func connectStatusAboutDestination(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	case http.StatusProxyAuthRequired:
+		return false
+	}
+	return status >= 400 && status < 500
+}
+
+// bufferedConn returns bytes read ahead while parsing the CONNECT response
+// before reading from the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// idleTimeoutConn closes the connection once no data has been read or
+// written for the timeout, by pushing the deadline forward on every call.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+func (c *idleTimeoutConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// closeWrite shuts down the sending side of conn so the peer sees EOF while
+// the response can still be read, closing conn entirely when that is not
+// supported.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// proxyHostPort returns the address of the proxy server, adding the default
+// port of the scheme when the URL has none.
+func proxyHostPort(parsedURL *url.URL) string {
+	if parsedURL.Port() != "" {
+		return parsedURL.Host
+	}
+
+	switch parsedURL.Scheme {
+	case "http":
+		return net.JoinHostPort(parsedURL.Hostname(), "80")
+	case "https":
+		return net.JoinHostPort(parsedURL.Hostname(), "443")
+	default:
+		return net.JoinHostPort(parsedURL.Hostname(), "1080")
+	}
+}
+
+func tlsClientHandshake(ctx context.Context, conn net.Conn, parsedURL *url.URL, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = parsedURL.Hostname()
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	err := runHandshake(ctx, conn, timeout, func() error {
+		return tlsConn.Handshake()
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", parsedURL.Host, err)
+	}
+
+	return tlsConn, nil
+}
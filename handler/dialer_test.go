@@ -0,0 +1,490 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// connectProxyServer is an HTTP handler tunnelling CONNECT requests.
+var connectProxyServer = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+})
+
+// startTLSProxy starts connectProxyServer over TLS with the server settings
+// of tlsConfig, which may be nil.
+func startTLSProxy(t *testing.T, tlsConfig *tls.Config) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(connectProxyServer)
+	server.TLS = tlsConfig
+	// Failed handshakes are expected.
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// writePEM writes the PEM blocks to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name string, blocks ...*pem.Block) string {
+	t.Helper()
+
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(block)...)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clientCertificate creates a self-signed client certificate and returns it
+// with the paths of its certificate and key files.
+func clientCertificate(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goProxy test client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := writePEM(t, dir, "client.pem", &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyFile := writePEM(t, dir, "client.key", &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, certFile, keyFile
+}
+
+// dialThrough connects to target through the upstream proxy of the handler.
+func dialThrough(handler *ProxyHandler, target string) error {
+	entry := handler.decision.config.Proxies["upstream"]
+	conn, err := handler.dialUpstream(context.Background(), entry, entry.URLs[0], "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if string(reply) != "ping" {
+		return fmt.Errorf("got %q through the tunnel", reply)
+	}
+	return nil
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := clientCertificate(t, dir)
+
+	server := startTLSProxy(t, nil)
+	caFile := writePEM(t, dir, "ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	mutualServer := startTLSProxy(t, &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs})
+
+	// The test certificate is valid for 127.0.0.1 and example.com.
+	serverURL, _ := url.Parse(server.URL)
+	byName := "https://localhost:" + serverURL.Port()
+	target := echoServer(t)
+
+	tests := []struct {
+		name     string
+		proxyURL string
+		tls      string
+		wantErr  bool
+	}{
+		{"no CA", server.URL, "", true},
+		{"CA file", server.URL, fmt.Sprintf("caFile: %q", caFile), false},
+		{"name not in the certificate", byName, fmt.Sprintf("caFile: %q", caFile), true},
+		{"server name", byName, fmt.Sprintf("caFile: %q\n      serverName: example.com", caFile), false},
+		{"insecure skip verify", byName, "insecureSkipVerify: true", false},
+		{"client certificate", mutualServer.URL,
+			fmt.Sprintf("caFile: %q\n      certFile: %q\n      keyFile: %q", caFile, certFile, keyFile), false},
+		{"missing client certificate", mutualServer.URL, fmt.Sprintf("caFile: %q", caFile), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsSection := ""
+			if tt.tls != "" {
+				tlsSection = "    tls:\n      " + tt.tls + "\n"
+			}
+			handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+proxies:
+  upstream:
+    urls: [%q]
+%srules: []
+`, tt.proxyURL, tlsSection))
+
+			err := dialThrough(handler, target)
+			if tt.wantErr && err == nil {
+				t.Error("connected without a trusted TLS handshake")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("dial failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPSChainServerName(t *testing.T) {
+	dir := t.TempDir()
+	first := startTLSProxy(t, nil)
+	second := startTLSProxy(t, nil)
+	caFile := writePEM(t, dir, "ca.pem",
+		&pem.Block{Type: "CERTIFICATE", Bytes: first.Certificate().Raw},
+		&pem.Block{Type: "CERTIFICATE", Bytes: second.Certificate().Raw})
+	target := echoServer(t)
+
+	// The test certificates are valid for 127.0.0.1 and example.com.
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	firstByName := "https://localhost:" + firstURL.Port()
+	secondByName := "https://localhost:" + secondURL.Port()
+
+	tests := []struct {
+		name    string
+		chain   string
+		wantErr bool
+	}{
+		{"second hop by its address", firstByName + " -> " + second.URL, false},
+		{"second hop by a name not in its certificate", firstByName + " -> " + secondByName, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+proxies:
+  upstream:
+    urls: [%q]
+    tls:
+      caFile: %q
+      serverName: example.com
+rules: []
+`, tt.chain, caFile))
+
+			err := dialThrough(handler, target)
+			if tt.wantErr && err == nil {
+				t.Error("the server name of the first hop was used for the second one")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("dial failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestInvalidTLSSettingsRefuseDials(t *testing.T) {
+	targets := make(chan string, 1)
+	upstream := recordingProxy(t, targets)
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+proxies:
+  upstream:
+    urls: [%q]
+    tls:
+      caFile: %q
+rules: []
+`, upstream.URL, filepath.Join(t.TempDir(), "missing.pem")))
+
+	if err := dialThrough(handler, echoServer(t)); err == nil {
+		t.Error("dialled through a proxy whose TLS settings could not be loaded")
+	}
+	if len(targets) > 0 {
+		t.Errorf("upstream was asked for %s", <-targets)
+	}
+}
+
+// recordingProxy starts a CONNECT proxy that sends the target of every
+// tunnel to targets.
+func recordingProxy(t *testing.T, targets chan<- string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets <- r.Host
+		connectProxyServer(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseProxyChain(t *testing.T) {
+	hops, err := parseProxyChain("socks5://a:1080 -> http://user:pw@b:3128->https://c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, hop := range hops {
+		got = append(got, hop.String())
+	}
+	want := []string{"socks5://a:1080", "http://user:pw@b:3128", "https://c"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parseProxyChain() = %v, want %v", got, want)
+	}
+
+	if _, err := parseProxyChain("http://a:3128 -> ://b"); err == nil {
+		t.Error("invalid hop accepted")
+	}
+}
+
+func TestProxyChain(t *testing.T) {
+	targets := make(chan string, 4)
+	first := recordingProxy(t, targets)
+	second := recordingProxy(t, targets)
+	target := echoServer(t)
+	socksAddr := startSocksServer(t, newTestHandler(t, "defaultProxy: direct\nrules: []\n"))
+
+	secondURL, _ := url.Parse(second.URL)
+	tests := []struct {
+		name  string
+		chain string
+		want  []string
+	}{
+		{"http then http", first.URL + " -> " + second.URL, []string{secondURL.Host, target}},
+		{"socks5 then http", "socks5://" + socksAddr + " -> " + second.URL, []string{target}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+proxies:
+  upstream: %q
+rules: []
+`, tt.chain))
+			if err := dialThrough(handler, target); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range tt.want {
+				if got := <-targets; got != want {
+					t.Errorf("hop was asked for %s, want %s", got, want)
+				}
+			}
+			if len(targets) > 0 {
+				t.Errorf("unexpected tunnel to %s", <-targets)
+			}
+		})
+	}
+}
+
+// fullListener returns the address of a listener that never accepts and
+// whose backlog is full, so that connecting to it hangs.
+func fullListener(t *testing.T) string {
+	t.Helper()
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sockaddr, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sockaddr.(*syscall.SockaddrInet4).Port)
+
+	// The first connection fills the backlog.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return addr
+}
+
+// silentServer returns the address of a TCP server that accepts connections
+// and never writes to them.
+func silentServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// hangingResolver answers no lookup until its context is done.
+type hangingResolver struct{}
+
+func (hangingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	<-ctx.Done()
+	return nil, 0, ctx.Err()
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	proxy := httptest.NewServer(connectProxyServer)
+	defer proxy.Close()
+
+	tests := []struct {
+		name      string
+		upstream  string
+		timeouts  string
+		linuxOnly bool
+	}{
+		// A full backlog only makes connections hang on Linux.
+		{"connect", "http://" + fullListener(t), "connectSeconds: 1", true},
+		{"handshake", "http://" + silentServer(t), "handshakeSeconds: 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linuxOnly && runtime.GOOS != "linux" {
+				t.Skip("not supported on " + runtime.GOOS)
+			}
+			handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: slow
+proxies:
+  slow:
+    urls: [%q]
+    timeouts:
+      %s
+rules: []
+`, tt.upstream, tt.timeouts))
+			entry := handler.decision.config.Proxies["slow"]
+
+			start := time.Now()
+			_, err := handler.dialUpstream(context.Background(), entry, entry.URLs[0], "tcp", "192.0.2.1:80")
+			if err == nil {
+				t.Fatal("dial through the hanging upstream succeeded")
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("dial gave up after %v, want about 1s", elapsed)
+			}
+		})
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+proxies:
+  upstream:
+    urls: [%q]
+    timeouts:
+      idleSeconds: 1
+rules: []
+`, proxy.URL))
+		entry := handler.decision.config.Proxies["upstream"]
+
+		conn, err := handler.dialUpstream(context.Background(), entry, entry.URLs[0], "tcp", silentServer(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		start := time.Now()
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("read from the silent connection succeeded")
+		}
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+			t.Errorf("idle connection closed after %v, want about 1s", elapsed)
+		}
+	})
+
+	t.Run("resolution", func(t *testing.T) {
+		handler := newTestHandler(t, "defaultProxy: direct\nrules: []\n")
+		handler.cache.SetResolver(hangingResolver{})
+		entry := handler.decision.config.Proxies["direct"]
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := handler.dialUpstream(ctx, entry, "", "tcp", "hanging.example:80")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("dialUpstream() = %v, want the deadline of the dial", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("dial waited %v for the lookup", elapsed)
+		}
+	})
+}
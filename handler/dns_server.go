@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"goProxy/config"
+	"goProxy/logger"
+	"goProxy/resolver"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTCPIdleTimeout = 10 * time.Second
+	dnsBlockTTL       = 60
+)
+
+// ErrDNSServerClosed is returned by the Serve methods after Close.
+var ErrDNSServerClosed = errors.New("dns: server closed")
+
+// DNSServer answers DNS queries over UDP and TCP by forwarding them to the
+// upstream resolvers, except for names the rules of its listener block.
+type DNSServer struct {
+	Addr     string
+	listener string
+	handler  *ProxyHandler
+
+	packetConn  net.PacketConn
+	netListener net.Listener
+	conns       map[net.Conn]struct{}
+	closed      bool
+	mu          sync.Mutex
+}
+
+// NewDNSServer returns a server for the named listener, which blocks names
+// with the rules selected for that listener.
+func NewDNSServer(name, addr string, handler *ProxyHandler) *DNSServer {
+	return &DNSServer{
+		Addr:     addr,
+		listener: name,
+		handler:  handler,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// ServeUDP answers queries arriving on conn until Close is called.
+func (s *DNSServer) ServeUDP(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrDNSServerClosed
+	}
+	s.packetConn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrDNSServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if response := s.answer(query, remoteIP(from), "udp"); response != nil {
+				conn.WriteTo(response, from)
+			}
+		}()
+	}
+}
+
+// ServeTCP accepts clients on listener until Close is called.
+func (s *DNSServer) ServeTCP(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrDNSServerClosed
+	}
+	s.netListener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrDNSServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrDNSServerClosed
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops answering queries and closes all active connections.
+func (s *DNSServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	if s.packetConn != nil {
+		err = s.packetConn.Close()
+	}
+	if s.netListener != nil {
+		if closeErr := s.netListener.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *DNSServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+func (s *DNSServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *DNSServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// serveConn answers the length-prefixed queries of a TCP client one by one.
+func (s *DNSServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	clientIP := remoteIP(conn.RemoteAddr())
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := resolver.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+
+		response := s.answer(query, clientIP, "tcp")
+		if response == nil {
+			return
+		}
+		if err := resolver.WriteMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to a query, or nil when the query cannot be
+// parsed well enough to answer it.
+func (s *DNSServer) answer(query []byte, clientIP net.IP, network string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return dnsResponse(header, nil, dnsmessage.RCodeFormatError, nil)
+	}
+
+	p := s.handler
+	p.mu.RLock()
+	acl := p.acl
+	config := p.decision.config
+	forwarder := p.dnsForwarder
+	p.mu.RUnlock()
+
+	if !acl.allows(clientIP) {
+		logger.Warn("Refusing DNS client %s", clientIP)
+		return dnsResponse(header, &question, dnsmessage.RCodeRefused, nil)
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+
+	p.mu.RLock()
+	proxyEntry, decisionResult, err := p.decisionFor(s.listener).GetProxyForName(name, clientInfo{ip: clientIP})
+	p.mu.RUnlock()
+
+	if err != nil {
+		logger.Error("Error getting proxy decision: %v", err)
+	} else if proxyEntry.IsBlock() {
+		logger.Info("Blocking DNS query for %s (rule: '%s', proxy: '%s')", name, decisionResult.RuleName, decisionResult.Proxy)
+		return blockedDNSResponse(header, question, config.GetDNSBlockResponse())
+	}
+
+	if p.usesFakeIP(config, question, name) {
+		if response := p.fakeIPResponse(header, question, name); response != nil {
+			if config.ShouldLog(logger.LogLevelDebug) {
+				logger.Debug("Answered DNS query for %s (%s) with a fake IP", name, question.Type)
+			}
+			return response
+		}
+	}
+
+	if forwarder == nil {
+		logger.Error("DNS query for %s failed: no upstream resolver configured", name)
+		return dnsResponse(header, &question, dnsmessage.RCodeServerFailure, nil)
+	}
+
+	if config.ShouldLog(logger.LogLevelDebug) {
+		logger.Debug("Forwarding DNS query for %s (%s)", name, question.Type)
+	}
+	response, err := forwarder.Exchange(context.Background(), network, query)
+	if err != nil {
+		logger.Warn("DNS query for %s failed: %v", name, err)
+		return dnsResponse(header, &question, dnsmessage.RCodeServerFailure, nil)
+	}
+	return response
+}
+
+// blockedDNSResponse answers a query for a blocked name with NXDOMAIN, or
+// with the unspecified address when blockResponse is "zero".
+func blockedDNSResponse(header dnsmessage.Header, question dnsmessage.Question, blockResponse string) []byte {
+	if blockResponse != config.DNSBlockZero {
+		return dnsResponse(header, &question, dnsmessage.RCodeNameError, nil)
+	}
+
+	resourceHeader := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  question.Type,
+		Class: question.Class,
+		TTL:   dnsBlockTTL,
+	}
+	var answers []dnsmessage.Resource
+	switch question.Type {
+	case dnsmessage.TypeA:
+		answers = append(answers, dnsmessage.Resource{Header: resourceHeader, Body: &dnsmessage.AResource{}})
+	case dnsmessage.TypeAAAA:
+		answers = append(answers, dnsmessage.Resource{Header: resourceHeader, Body: &dnsmessage.AAAAResource{}})
+	}
+	return dnsResponse(header, &question, dnsmessage.RCodeSuccess, answers)
+}
+
+// dnsResponse builds the response to the query with the given header.
+func dnsResponse(query dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, answers []dnsmessage.Resource) []byte {
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Answers: answers,
+	}
+	if question != nil {
+		message.Questions = []dnsmessage.Question{*question}
+	}
+
+	response, err := message.Pack()
+	if err != nil {
+		logger.Error("Error packing DNS response: %v", err)
+		return nil
+	}
+	return response
+}
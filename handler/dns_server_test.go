@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstreamAddr is the address upstreamDNS answers A queries with.
+var upstreamAddr = [4]byte{192, 0, 2, 53}
+
+// upstreamDNS returns the address of a UDP DNS server answering A queries
+// with upstreamAddr, and other queries with no answer.
+func upstreamDNS(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var request dnsmessage.Message
+			if err := request.Unpack(buf[:n]); err != nil || len(request.Questions) != 1 {
+				continue
+			}
+			question := request.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: request.ID, Response: true, RecursionAvailable: true},
+				Questions: request.Questions,
+			}
+			if question.Type == dnsmessage.TypeA {
+				response.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: 300},
+					Body:   &dnsmessage.AResource{A: upstreamAddr},
+				}}
+			}
+			if packed, err := response.Pack(); err == nil {
+				conn.WriteTo(packed, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// queryDNS asks server for the addresses of name and returns the response
+// code and the addresses.
+func queryDNS(t *testing.T, server *DNSServer, name string, qtype dnsmessage.Type) (dnsmessage.RCode, []net.IP) {
+	t.Helper()
+
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name + "."), Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(server.answer(query, net.IPv4(127, 0, 0, 1), "udp")); err != nil {
+		t.Fatalf("invalid response for %s: %v", name, err)
+	}
+
+	var ips []net.IP
+	for _, answer := range response.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return response.RCode, ips
+}
+
+func TestDNSServerFakeIP(t *testing.T) {
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: direct
+dns:
+  servers: [%q]
+fakeIP:
+  range: "198.18.0.0/24"
+  exclude: "*.lan"
+rules:
+  - hosts: "blocked.example"
+    proxy: block
+`, upstreamDNS(t)))
+	server := NewDNSServer("", "", handler)
+
+	rcode, ips := queryDNS(t, server, "app.example", dnsmessage.TypeA)
+	if rcode != dnsmessage.RCodeSuccess || len(ips) != 1 || ips[0].String() != "198.18.0.1" {
+		t.Fatalf("got %v %v, want the first fake IP", rcode, ips)
+	}
+	if host, err := handler.unmapFakeIP("198.18.0.1:443"); err != nil || host != "app.example:443" {
+		t.Errorf("unmapFakeIP() = %q, %v, want app.example:443", host, err)
+	}
+	if _, err := handler.unmapFakeIP("198.18.0.99:443"); err == nil {
+		t.Error("unmapFakeIP() succeeded for an address never handed out")
+	}
+
+	if rcode, ips := queryDNS(t, server, "app.example", dnsmessage.TypeAAAA); rcode != dnsmessage.RCodeSuccess || len(ips) != 0 {
+		t.Errorf("AAAA got %v %v, want an empty answer", rcode, ips)
+	}
+	if rcode, _ := queryDNS(t, server, "blocked.example", dnsmessage.TypeA); rcode != dnsmessage.RCodeNameError {
+		t.Errorf("blocked name got %v, want NXDOMAIN", rcode)
+	}
+	if _, ips := queryDNS(t, server, "printer.lan", dnsmessage.TypeA); len(ips) != 1 || !ips[0].Equal(net.IP(upstreamAddr[:])) {
+		t.Errorf("excluded name got %v, want the upstream answer", ips)
+	}
+
+	// A reload turning fake IPs off while the query is answered.
+	handler.cache.SetFakeIPRange(nil, 0)
+	if _, ips := queryDNS(t, server, "other.example", dnsmessage.TypeA); len(ips) != 1 || !ips[0].Equal(net.IP(upstreamAddr[:])) {
+		t.Errorf("got %v without fake IPs, want the upstream answer", ips)
+	}
+}
+
+func TestDNSServerSystemUpstreamEmptyAnswer(t *testing.T) {
+	// The system resolver asks upstreamDNS, which has no AAAA records.
+	stub := upstreamDNS(t)
+	defaultResolver := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", stub)
+		},
+	}
+	t.Cleanup(func() { net.DefaultResolver = defaultResolver })
+
+	handler := newTestHandler(t, `
+defaultProxy: direct
+dns:
+  servers: [system]
+rules: []
+`)
+	server := NewDNSServer("", "", handler)
+
+	if rcode, ips := queryDNS(t, server, "ipv4only.example", dnsmessage.TypeAAAA); rcode != dnsmessage.RCodeSuccess || len(ips) != 0 {
+		t.Errorf("AAAA got %v %v, want an empty answer", rcode, ips)
+	}
+	if rcode, ips := queryDNS(t, server, "ipv4only.example", dnsmessage.TypeA); rcode != dnsmessage.RCodeSuccess || len(ips) != 1 || !ips[0].Equal(net.IP(upstreamAddr[:])) {
+		t.Errorf("A got %v %v, want the upstream answer", rcode, ips)
+	}
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"goProxy/config"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeIPTTL keeps clients asking again, so that names in use stay mapped.
+const fakeIPTTL = 1
+
+// unmapFakeIP replaces a fake IP in host or host:port with the name it was
+// handed out for. Other addresses are returned unchanged; a fake IP that is
+// not mapped to a name, as after a restart, is an error.
+func (p *ProxyHandler) unmapFakeIP(hostport string) (string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.Trim(hostport, "[]"), ""
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !p.cache.IsFakeIP(ip) {
+		return hostport, nil
+	}
+	name, ok := p.cache.FakeIPHost(ip)
+	if !ok {
+		return "", fmt.Errorf("fake IP %s is not mapped to a name", host)
+	}
+
+	if port == "" {
+		return name, nil
+	}
+	return net.JoinHostPort(name, port), nil
+}
+
+// fakeIPResponse answers an address query for name with its fake IP, or
+// with no address for AAAA queries so that clients fall back to IPv4. It
+// returns nil when fake IPs were turned off since the query was checked.
+func (p *ProxyHandler) fakeIPResponse(header dnsmessage.Header, question dnsmessage.Question, name string) []byte {
+	var answers []dnsmessage.Resource
+	if question.Type == dnsmessage.TypeA {
+		ip := p.cache.FakeIP(name)
+		if ip == nil {
+			return nil
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  question.Type,
+				Class: question.Class,
+				TTL:   fakeIPTTL,
+			},
+			Body: &a,
+		})
+	} else if !p.cache.HasFakeIPs() {
+		return nil
+	}
+	return dnsResponse(header, &question, dnsmessage.RCodeSuccess, answers)
+}
+
+// usesFakeIP reports whether a query is answered with a fake IP: address
+// queries while fake IPs are on, except for excluded names.
+func (p *ProxyHandler) usesFakeIP(cfg *config.ProxyConfig, question dnsmessage.Question, name string) bool {
+	if cfg.GetFakeIPRange() == nil || question.Class != dnsmessage.ClassINET {
+		return false
+	}
+	if question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeAAAA {
+		return false
+	}
+
+	for _, pattern := range cfg.GetFakeIPExclude() {
+		if pattern == name {
+			return false
+		}
+		if g, err := p.cache.GetGlob(pattern); err == nil && g.Match(name) {
+			return false
+		}
+	}
+	return true
+}
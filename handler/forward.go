@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"goProxy/logger"
+)
+
+const forwardContextKey contextKey = "forward"
+
+// forwardTarget returns the upstream that a plain HTTP request is forwarded
+// to as an absolute-URI request, or nil when the request has to be tunnelled.
+// Only single-hop http:// upstreams of entries with forwardHTTP qualify, and
+// in groups every member has to, with the same credentials, so that a failed
+// member can be replaced by the next one.
+func forwardTarget(selection upstreamSelection, targetURL *url.URL) *url.URL {
+	if !selection.entry.ForwardHTTP || targetURL.Scheme != "http" || len(selection.urls) == 0 {
+		return nil
+	}
+
+	var target *url.URL
+	for _, proxyURL := range selection.urls {
+		parsedURL := parseForwardURL(proxyURL)
+		if parsedURL == nil {
+			return nil
+		}
+		if target == nil {
+			target = parsedURL
+		} else if parsedURL.User.String() != target.User.String() {
+			return nil
+		}
+	}
+	return target
+}
+
+// parseForwardURL returns proxyURL parsed if it is a single-hop http://
+// upstream, or nil.
+func parseForwardURL(proxyURL string) *url.URL {
+	if strings.Contains(proxyURL, chainSeparator) {
+		return nil
+	}
+
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil || parsedURL.Scheme != "http" {
+		return nil
+	}
+	return parsedURL
+}
+
+// forwardProxy is the Proxy function of the transport. It returns the
+// upstream chosen for the request, which makes the transport send the
+// absolute URI and the Proxy-Authorization header instead of tunnelling.
+// Other requests use the proxy of the environment, if any.
+func forwardProxy(req *http.Request) (*url.URL, error) {
+	if proxyURL, ok := req.Context().Value(forwardContextKey).(*url.URL); ok {
+		return proxyURL, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// dialForwardProxy connects to the upstream itself, honouring the bind and
+// timeouts of the entry. The members of a group are tried in order, and a
+// failing one is put into cooldown.
+func (p *ProxyHandler) dialForwardProxy(ctx context.Context, selection upstreamSelection, network string) (net.Conn, error) {
+	proxyEntry := selection.entry
+
+	var lastErr error
+	for _, proxyURL := range selection.urls {
+		parsedURL := parseForwardURL(proxyURL)
+		if parsedURL == nil {
+			return nil, fmt.Errorf("upstream %s cannot forward HTTP requests", describeUpstream(proxyURL))
+		}
+
+		conn, err := p.dialUpstream(ctx, proxyEntry, "", network, proxyHostPort(parsedURL))
+		if err == nil {
+			if proxyEntry.IsGroup() {
+				p.upstreams.markHealthy(proxyURL)
+			}
+			return conn, nil
+		}
+		// The destination of the dial is the upstream itself.
+		err = upstreamError(err)
+		if !proxyEntry.IsGroup() || ctx.Err() != nil {
+			return nil, err
+		}
+
+		logger.Warn("Upstream %s failed: %v", describeUpstream(proxyURL), err)
+		p.upstreams.markFailed(proxyURL, proxyEntry.GetCooldown())
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("all upstreams failed, last error: %w", lastErr)
+}
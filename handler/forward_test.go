@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"goProxy/config"
+)
+
+func TestForwardTarget(t *testing.T) {
+	targetURL, _ := url.Parse("http://example.com/")
+	httpsURL, _ := url.Parse("https://example.com/")
+
+	tests := []struct {
+		name    string
+		urls    []string
+		target  *url.URL
+		forward bool
+		want    string
+	}{
+		{"single http upstream", []string{"http://a:3128"}, targetURL, true, "http://a:3128"},
+		{"forwardHTTP off", []string{"http://a:3128"}, targetURL, false, ""},
+		{"https request", []string{"http://a:3128"}, httpsURL, true, ""},
+		{"socks upstream", []string{"socks5://a:1080"}, targetURL, true, ""},
+		{"chain", []string{"http://a:3128 -> http://b:3128"}, targetURL, true, ""},
+		{"group with the same credentials", []string{"http://u:p@a:3128", "http://u:p@b:3128"}, targetURL, true, "http://u:p@a:3128"},
+		{"group with other credentials", []string{"http://u:p@a:3128", "http://v:p@b:3128"}, targetURL, true, ""},
+		{"mixed group", []string{"http://a:3128", "socks5://b:1080"}, targetURL, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &config.ProxyEntry{URLs: tt.urls, ForwardHTTP: tt.forward}
+			got := forwardTarget(upstreamSelection{entry: entry, urls: tt.urls}, tt.target)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("forwardTarget() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tt.want {
+				t.Errorf("forwardTarget() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestForwardFailover sends a plain HTTP request through a forwardHTTP group
+// whose first member is down.
+func TestForwardFailover(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			// A health check probe.
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		mu.Lock()
+		seen = append(seen, r.RequestURI+" "+r.Header.Get("Proxy-Authorization"))
+		mu.Unlock()
+		fmt.Fprint(w, "forwarded")
+	}))
+	defer upstream.Close()
+
+	dead := deadAddr(t)
+	upstreamURL, _ := url.Parse(upstream.URL)
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: group
+healthCheck:
+  target: %q
+  intervalSeconds: 3600
+proxies:
+  group:
+    urls: ["http://user:pass@%s", "http://user:pass@%s"]
+    forwardHTTP: true
+rules: []
+`, dead, dead, upstreamURL.Host))
+	// A late health check result must not undo the failover below.
+	handler.healthChecker.Stop()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   10 * time.Second,
+	}
+	resp, err := client.Get("http://example.invalid/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "forwarded" {
+		t.Fatalf("got %d %q, want the answer of the second member", resp.StatusCode, body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen[0] != "http://example.invalid/page Basic dXNlcjpwYXNz" {
+		t.Errorf("upstream got %q, want the absolute URI with credentials", seen)
+	}
+
+	entry := handler.currentConfig().Proxies["group"]
+	if selection := handler.upstreams.order(entry); selection.urls[0] != entry.URLs[1] {
+		t.Errorf("first member still preferred after failing: %v", selection.urls)
+	}
+}
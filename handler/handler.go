@@ -1,9 +1,7 @@
 package handler
 
 import (
-	"bufio"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"net"
 	"net/http"
@@ -13,21 +11,32 @@ import (
 	"time"
 
 	"github.com/elazarl/goproxy"
-	"golang.org/x/net/proxy"
 
 	"goProxy/cache"
 	"goProxy/config"
 	"goProxy/logger"
+	"goProxy/resolver"
 )
 
 type contextKey string
 
-const proxyURLContextKey contextKey = "proxyURL"
+const (
+	proxyContextKey    contextKey = "proxy"
+	listenerContextKey contextKey = "listener"
+)
 
 type ProxyHandler struct {
-	decision    *ProxyDecision
-	proxyServer *goproxy.ProxyHttpServer
-	mu          sync.RWMutex
+	decision          *ProxyDecision
+	listenerDecisions map[string]*ProxyDecision
+	auth              *authenticator
+	acl               *clientACL
+	dnsForwarder      *resolver.Resolver
+	proxyServer       *goproxy.ProxyHttpServer
+	cache             *cache.CacheManager
+	upstreams         *upstreamState
+	transports        *transportPool
+	healthChecker     *healthChecker
+	mu                sync.RWMutex
 }
 
 func NewProxyHandler(config *config.ProxyConfig, cacheManager *cache.CacheManager) *ProxyHandler {
@@ -40,14 +49,28 @@ func NewProxyHandler(config *config.ProxyConfig, cacheManager *cache.CacheManage
 	proxyServer.Logger = goproxyLogger
 
 	handler := &ProxyHandler{
-		decision:    decision,
-		proxyServer: proxyServer,
+		decision:          decision,
+		listenerDecisions: newListenerDecisions(config, cacheManager, decision),
+		auth:              newAuthenticator(config),
+		acl:               newClientACL(config, cacheManager),
+		proxyServer:       proxyServer,
+		cache:             cacheManager,
+		upstreams:         newUpstreamState(),
 	}
 
 	tr := http.DefaultTransport.(*http.Transport).Clone()
 	tr.DialContext = handler.dialContext
+	tr.Proxy = forwardProxy
 
 	proxyServer.Tr = tr
+	handler.transports = newTransportPool(tr)
+	proxyServer.OnRequest().DoFunc(selectTransport)
+
+	handler.applyResolvers(nil, config, cacheManager)
+	handler.loadCaches()
+
+	handler.healthChecker = newHealthChecker(handler, config)
+	handler.healthChecker.Start()
 
 	return handler
 }
@@ -56,91 +79,119 @@ func (p *ProxyHandler) UpdateConfig(config *config.ProxyConfig, cache *cache.Cac
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	oldConfig := p.decision.config
+	oldDecisions := p.allDecisions()
+	p.applyResolvers(oldConfig, config, cache)
+
 	p.decision = NewProxyDecision(config, cache)
+	p.listenerDecisions = newListenerDecisions(config, cache, p.decision)
+	p.adoptCaches(oldDecisions, oldConfig)
+	p.auth = newAuthenticator(config)
+	p.acl = newClientACL(config, cache)
+
+	p.transports.closeIdle()
+	p.transports = newTransportPool(p.proxyServer.Tr)
 
 	goproxyLogger := logger.NewGoproxyLoggerAdapter(logger.GetLogger())
 	p.proxyServer.Logger = goproxyLogger
+
+	p.healthChecker.Stop()
+	p.healthChecker = newHealthChecker(p, config)
+	p.upstreams.prune(p.healthChecker.groupMembers())
+	p.healthChecker.Start()
 }
 
-func (p *ProxyHandler) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	proxyURL, ok := ctx.Value(proxyURLContextKey).(string)
-	if !ok {
-		return nil, fmt.Errorf("proxy URL not found in context")
-	}
+func (p *ProxyHandler) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	if proxyURL == "#" {
-		return nil, fmt.Errorf("connection blocked by proxy configuration")
-	}
+	p.healthChecker.Stop()
+	p.transports.closeIdle()
+	p.saveCaches()
+}
 
-	if proxyURL == "" {
-		return net.Dial(network, addr)
-	}
+// ListenerHandler returns the HTTP handler of the named listener, which
+// routes with the rules selected for that listener.
+func (p *ProxyHandler) ListenerHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenerContextKey, name)
+		p.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-	parsedURL, err := url.Parse(proxyURL)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing proxy URL: %w", err)
+// decisionFor returns the decision of the named listener. The caller must
+// hold p.mu.
+func (p *ProxyHandler) decisionFor(listener string) *ProxyDecision {
+	if decision, exists := p.listenerDecisions[listener]; exists {
+		return decision
 	}
+	return p.decision
+}
 
-	switch parsedURL.Scheme {
-	case "socks5", "socks5h":
-		var auth *proxy.Auth
-		if parsedURL.User != nil {
-			auth = &proxy.Auth{
-				User: parsedURL.User.Username(),
-			}
-			if password, ok := parsedURL.User.Password(); ok {
-				auth.Password = password
-			}
-		}
-		dialer, err := proxy.SOCKS5("tcp", parsedURL.Host, auth, proxy.Direct)
-		if err != nil {
-			return nil, fmt.Errorf("error creating SOCKS5 dialer: %w", err)
-		}
-		return dialer.Dial(network, addr)
-	case "http", "https":
-		conn, err := net.Dial("tcp", parsedURL.Host)
-		if err != nil {
-			return nil, fmt.Errorf("error connecting to HTTP proxy: %w", err)
-		}
+func (p *ProxyHandler) currentConfig() *config.ProxyConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
-		connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	return p.decision.config
+}
 
-		if parsedURL.User != nil {
-			username := parsedURL.User.Username()
-			password, _ := parsedURL.User.Password()
-			credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
-			connectReq += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials)
-		}
+func (p *ProxyHandler) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	selection, ok := ctx.Value(proxyContextKey).(upstreamSelection)
+	if !ok {
+		return nil, fmt.Errorf("proxy not found in context")
+	}
+
+	if _, ok := ctx.Value(forwardContextKey).(*url.URL); ok {
+		return p.dialForwardProxy(ctx, selection, network)
+	}
 
-		connectReq += "\r\n"
+	proxyEntry := selection.entry
+	if !proxyEntry.IsGroup() {
+		return p.dialUpstream(ctx, proxyEntry, proxyEntry.URLs[0], network, addr)
+	}
 
-		if _, err := conn.Write([]byte(connectReq)); err != nil {
-			conn.Close()
-			return nil, fmt.Errorf("error sending CONNECT request: %w", err)
+	var lastErr error
+	for _, proxyURL := range selection.urls {
+		conn, err := p.dialUpstream(ctx, proxyEntry, proxyURL, network, addr)
+		if err == nil {
+			p.upstreams.markHealthy(proxyURL)
+			return conn, nil
 		}
-
-		reader := bufio.NewReader(conn)
-		resp, err := http.ReadResponse(reader, nil)
-		if err != nil {
-			conn.Close()
-			return nil, fmt.Errorf("error reading proxy response: %w", err)
+		if ctx.Err() != nil {
+			return nil, err
 		}
-		resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			conn.Close()
-			return nil, fmt.Errorf("proxy CONNECT failed with status: %d %s", resp.StatusCode, resp.Status)
+		if isDestinationError(err) {
+			p.upstreams.markHealthy(proxyURL)
+			return nil, err
 		}
 
-		return conn, nil
-	default:
-		return nil, fmt.Errorf("unsupported proxy scheme: %s", parsedURL.Scheme)
+		logger.Warn("Upstream %s failed for %s: %v", describeUpstream(proxyURL), addr, err)
+		p.upstreams.markFailed(proxyURL, proxyEntry.GetCooldown())
+		lastErr = err
 	}
+
+	return nil, fmt.Errorf("all upstreams failed, last error: %w", lastErr)
 }
 
 func (p *ProxyHandler) handleRequest(w http.ResponseWriter, r *http.Request, isHTTPS bool) {
+	listener, _ := r.Context().Value(listenerContextKey).(string)
+	user, _ := r.Context().Value(userContextKey).(string)
+	client := clientInfo{user: user, ip: requestIP(r)}
+
+	host, err := p.unmapFakeIP(r.URL.Host)
+	if err != nil {
+		logger.Warn("Rejecting %s to %s: %v", getRequestType(isHTTPS), r.URL.Host, err)
+		http.Error(w, "Unknown fake IP", http.StatusBadGateway)
+		return
+	}
+	if host != r.URL.Host {
+		r.URL.Host = host
+		r.Host = host
+	}
+
 	p.mu.RLock()
-	proxyURL, decisionResult, err := p.decision.GetProxyForRequest(r)
+	proxyEntry, decisionResult, err := p.decisionFor(listener).GetProxyForRequest(r, client)
+	transports := p.transports
 	p.mu.RUnlock()
 
 	if err != nil {
@@ -149,7 +200,7 @@ func (p *ProxyHandler) handleRequest(w http.ResponseWriter, r *http.Request, isH
 		return
 	}
 
-	if proxyURL == "#" {
+	if proxyEntry.IsBlock() {
 		target := r.URL.Host
 		if isHTTPS {
 			target = r.Host
@@ -163,18 +214,32 @@ func (p *ProxyHandler) handleRequest(w http.ResponseWriter, r *http.Request, isH
 	if isHTTPS {
 		target = r.Host
 	}
-	if proxyURL == "" {
-		logger.Info("Direct %s to %s (rule: '%s', proxy: '%s')", getRequestType(isHTTPS), target, decisionResult.RuleName, decisionResult.Proxy)
-	} else {
-		logger.Info("%s to %s via proxy %s (rule: '%s')", capitalize(getRequestType(isHTTPS)), target, decisionResult.Proxy, decisionResult.RuleName)
+	selection := p.upstreams.order(proxyEntry)
+	logRoute(getRequestType(isHTTPS), target, selection, decisionResult)
+
+	ctx := context.WithValue(r.Context(), proxyContextKey, selection)
+	if !isHTTPS {
+		ctx = context.WithValue(ctx, transportContextKey, transports.get(decisionResult.Proxy, selection))
+		if forwardURL := forwardTarget(selection, r.URL); forwardURL != nil {
+			logger.Debug("Forwarding request to %s through %s without CONNECT", target, describeUpstream(forwardURL.String()))
+			ctx = context.WithValue(ctx, forwardContextKey, forwardURL)
+		}
 	}
-
-	ctx := context.WithValue(r.Context(), proxyURLContextKey, proxyURL)
 	r = r.WithContext(ctx)
 
 	p.proxyServer.ServeHTTP(w, r)
 }
 
+func logRoute(requestType, target string, selection upstreamSelection, decisionResult ProxyDecisionResult) {
+	if selection.entry.IsDirect() {
+		logger.Info("Direct %s to %s (rule: '%s', proxy: '%s')", requestType, target, decisionResult.RuleName, decisionResult.Proxy)
+	} else if selection.entry.IsGroup() {
+		logger.Info("%s to %s via proxy %s (rule: '%s', upstream: %s)", capitalize(requestType), target, decisionResult.Proxy, decisionResult.RuleName, selection.reason)
+	} else {
+		logger.Info("%s to %s via proxy %s (rule: '%s')", capitalize(requestType), target, decisionResult.Proxy, decisionResult.RuleName)
+	}
+}
+
 func getRequestType(isHTTPS bool) string {
 	if isHTTPS {
 		return "HTTPS CONNECT"
@@ -191,7 +256,7 @@ func capitalize(s string) string {
 
 func (p *ProxyHandler) GetHTTPClient(targetURL string) (*http.Client, error) {
 	p.mu.RLock()
-	proxyURL, parsedURL, decisionResult, err := p.decision.GetProxyForURL(targetURL)
+	proxyEntry, parsedURL, decisionResult, err := p.decision.GetProxyForURL(targetURL)
 	p.mu.RUnlock()
 
 	if err != nil {
@@ -201,17 +266,25 @@ func (p *ProxyHandler) GetHTTPClient(targetURL string) (*http.Client, error) {
 	isHTTPS := parsedURL.Scheme == "https"
 	target := parsedURL.Host
 
-	if proxyURL == "#" {
+	if proxyEntry.IsBlock() {
 		return nil, fmt.Errorf("request blocked by proxy configuration")
 	}
 
 	transport := http.Transport{}
 
-	if proxyURL == "" {
+	if proxyEntry.IsDirect() {
 		logger.Info("Direct %s to %s (rule: '%s', proxy: '%s')", getRequestType(isHTTPS), target, decisionResult.RuleName, decisionResult.Proxy)
 	} else {
+		selection := p.upstreams.order(proxyEntry)
+		forwardURL := forwardTarget(selection, parsedURL)
+		if forwardURL != nil {
+			transport.Proxy = http.ProxyURL(forwardURL)
+		}
 		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			ctx = context.WithValue(ctx, proxyURLContextKey, proxyURL)
+			ctx = context.WithValue(ctx, proxyContextKey, selection)
+			if forwardURL != nil {
+				ctx = context.WithValue(ctx, forwardContextKey, forwardURL)
+			}
 			return p.dialContext(ctx, network, addr)
 		}
 		logger.Info("%s to %s via proxy %s (rule: '%s')", capitalize(getRequestType(isHTTPS)), target, decisionResult.Proxy, decisionResult.RuleName)
@@ -226,6 +299,35 @@ func (p *ProxyHandler) GetHTTPClient(targetURL string) (*http.Client, error) {
 func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger.Debug("%s %s %s", r.Method, r.URL.String(), r.RemoteAddr)
 
+	p.mu.RLock()
+	auth := p.auth
+	acl := p.acl
+	p.mu.RUnlock()
+
+	if !acl.allows(requestIP(r)) {
+		logger.Warn("Refusing client %s", r.RemoteAddr)
+		http.Error(w, "Client not allowed", http.StatusForbidden)
+		return
+	}
+
+	if isPACRequest(r) {
+		p.servePAC(w, r)
+		return
+	}
+
+	user, ok := auth.authenticateRequest(r)
+	if !ok {
+		if user != "" {
+			logger.Warn("Proxy authentication failed for user '%s' from %s", user, r.RemoteAddr)
+		}
+		requireProxyAuth(w)
+		return
+	}
+	if user != "" {
+		r.Header.Del("Proxy-Authorization")
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	}
+
 	isHTTPS := r.Method == http.MethodConnect
 
 	p.handleRequest(w, r, isHTTPS)
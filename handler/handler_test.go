@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"goProxy/cache"
+	"goProxy/config"
+)
+
+// loadTestConfig loads a config from YAML, with the profile directory in a
+// temporary directory. Logging goes to stdout at the error level unless the
+// YAML sets it.
+func loadTestConfig(t *testing.T, cacheManager *cache.CacheManager, yaml string) *config.ProxyConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("PROFILE_PLACE", dir)
+
+	if !strings.Contains(yaml, "logLevel:") {
+		yaml += "\nlogLevel: error\n"
+	}
+	yaml += "\nlogFile: \"\"\n"
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.LoadConfig(path, cacheManager, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestHandler returns a handler for the config in YAML, closed when the
+// test ends.
+func newTestHandler(t *testing.T, yaml string) *ProxyHandler {
+	t.Helper()
+
+	cacheManager := cache.NewCacheManager()
+	handler := NewProxyHandler(loadTestConfig(t, cacheManager, yaml), cacheManager)
+	t.Cleanup(handler.Close)
+	return handler
+}
+
+// deadAddr returns a local address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"goProxy/config"
+	"goProxy/logger"
+)
+
+// healthChecker periodically probes every member of the proxy groups by
+// opening a connection to the configured target through it.
+type healthChecker struct {
+	handler *ProxyHandler
+	config  *config.ProxyConfig
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+type probeResult struct {
+	rtt time.Duration
+	err error
+}
+
+func newHealthChecker(handler *ProxyHandler, config *config.ProxyConfig) *healthChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &healthChecker{
+		handler: handler,
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (h *healthChecker) Start() {
+	members := h.groupMembers()
+	if len(members) == 0 {
+		return
+	}
+
+	interval := h.config.GetHealthCheckInterval()
+	logger.Info("Health checking %d upstreams every %s via %s", len(members), interval, h.config.GetHealthCheckTarget())
+
+	h.running.Add(1)
+	go func() {
+		defer h.running.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			h.checkAll(members)
+
+			select {
+			case <-ticker.C:
+			case <-h.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop aborts the probes in flight and returns once they are done. It may
+// be called more than once.
+func (h *healthChecker) Stop() {
+	h.cancel()
+	h.running.Wait()
+}
+
+// groupMembers returns the upstream URLs that belong to a group, mapped to
+// the first entry they appear in, whose options are used for the probe.
+func (h *healthChecker) groupMembers() map[string]*config.ProxyEntry {
+	members := make(map[string]*config.ProxyEntry)
+	for _, entry := range h.config.Proxies {
+		if !entry.IsGroup() {
+			continue
+		}
+		for _, proxyURL := range entry.URLs {
+			if proxyURL == "#" {
+				continue
+			}
+			if _, exists := members[proxyURL]; !exists {
+				members[proxyURL] = entry
+			}
+		}
+	}
+	return members
+}
+
+func (h *healthChecker) checkAll(members map[string]*config.ProxyEntry) {
+	var wg sync.WaitGroup
+	for proxyURL, entry := range members {
+		wg.Add(1)
+		go func(proxyURL string, entry *config.ProxyEntry) {
+			defer wg.Done()
+
+			result := h.probe(entry, proxyURL)
+			if h.ctx.Err() != nil {
+				return
+			}
+			h.handler.upstreams.recordCheck(proxyURL, result.rtt, entry.GetCooldown(), result.err)
+
+			if result.err != nil {
+				logger.Warn("Health check of %s failed: %v", describeUpstream(proxyURL), result.err)
+			} else if h.config.ShouldLog(logger.LogLevelDebug) {
+				logger.Debug("Health check of %s succeeded in %s", describeUpstream(proxyURL), result.rtt)
+			}
+		}(proxyURL, entry)
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) probe(entry *config.ProxyEntry, proxyURL string) probeResult {
+	ctx, cancel := context.WithTimeout(h.ctx, h.config.GetHealthCheckTimeout())
+	defer cancel()
+
+	start := time.Now()
+	conn, err := h.handler.dialUpstream(ctx, entry, proxyURL, "tcp", h.config.GetHealthCheckTarget())
+	if err != nil {
+		return probeResult{err: err}
+	}
+	rtt := time.Since(start)
+	conn.Close()
+
+	return probeResult{rtt: rtt}
+}
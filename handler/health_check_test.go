@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"goProxy/cache"
+)
+
+// connectProxy returns the address of an HTTP proxy that accepts every
+// CONNECT after delay, without tunnelling anything.
+func connectProxy(t *testing.T, delay time.Duration) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, _ := url.Parse(server.URL)
+	return serverURL.Host
+}
+
+func TestHealthCheckOrdersFastestGroup(t *testing.T) {
+	slow := connectProxy(t, 100*time.Millisecond)
+	fast := connectProxy(t, 0)
+	dead := deadAddr(t)
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: direct
+healthCheck:
+  target: "example.com:443"
+  intervalSeconds: 3600
+proxies:
+  fastest:
+    urls: ["http://%s", "http://%s", "http://%s"]
+    type: fastest
+rules: []
+`, dead, slow, fast))
+
+	entry := handler.currentConfig().Proxies["fastest"]
+	want := []string{"http://" + fast, "http://" + slow, "http://" + dead}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		selection := handler.upstreams.order(entry)
+		if fmt.Sprint(selection.urls) == fmt.Sprint(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order = %v, want %v", selection.urls, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckerStopTwice(t *testing.T) {
+	handler := newTestHandler(t, `
+defaultProxy: direct
+rules: []
+`)
+
+	handler.healthChecker.Stop()
+	handler.healthChecker.Stop()
+}
+
+func TestHealthCheckerStopWaitsForProbes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The upstream accepts the probe but never answers it.
+	probed := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			probed <- conn
+		}
+	}()
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: direct
+healthCheck:
+  target: "example.com:443"
+  timeoutSeconds: 60
+proxies:
+  group:
+    urls: ["http://%s", "http://%s"]
+    timeouts:
+      handshakeSeconds: 60
+rules: []
+`, listener.Addr(), deadAddr(t)))
+
+	select {
+	case conn := <-probed:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream was not probed")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		handler.healthChecker.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() did not abort the probe in flight")
+	}
+
+	entry := handler.currentConfig().Proxies["group"]
+	if selection := handler.upstreams.order(entry); selection.urls[0] != "http://"+listener.Addr().String() {
+		t.Errorf("order() = %v, the aborted probe counted as a failure", selection.urls)
+	}
+}
+
+func TestUpdateConfigForgetsRemovedUpstreams(t *testing.T) {
+	dir := t.TempDir()
+	kept, removed := "http://"+deadAddr(t), "http://"+deadAddr(t)
+	yaml := `
+defaultProxy: direct
+healthCheck:
+  intervalSeconds: 3600
+proxies:
+  group:
+    urls: [%q, %q]
+rules: []
+`
+	handler := startHandler(t, dir, fmt.Sprintf(yaml, kept, removed))
+	defer handler.Close()
+	handler.healthChecker.Stop()
+	handler.upstreams.markFailed(kept, time.Hour)
+	handler.upstreams.markFailed(removed, time.Hour)
+
+	cacheManager := cache.NewCacheManager()
+	cfg := loadTestConfig(t, cacheManager, fmt.Sprintf(yaml, kept, "direct"))
+	handler.UpdateConfig(cfg, cacheManager)
+	handler.healthChecker.Stop()
+
+	handler.upstreams.mu.RLock()
+	defer handler.upstreams.mu.RUnlock()
+	if _, exists := handler.upstreams.health[removed]; exists {
+		t.Error("state of the removed upstream kept after the reload")
+	}
+	if _, exists := handler.upstreams.health[kept]; !exists {
+		t.Error("state of the remaining upstream dropped by the reload")
+	}
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"goProxy/config"
+	"goProxy/logger"
+)
+
+// pacPaths are served with a PAC file generated from the rules of the
+// listener instead of being proxied.
+var pacPaths = map[string]bool{
+	"/proxy.pac": true,
+	"/wpad.dat":  true,
+}
+
+// maxPACConditions is the most hosts and networks a rule may have to be
+// expressed in PAC; bigger lists, like blocklists, would make the script
+// megabytes long and are left to goProxy.
+const maxPACConditions = 100
+
+// pacStatement is one "if (condition) return action;" of a PAC file.
+type pacStatement struct {
+	condition string
+	action    string
+}
+
+func isPACRequest(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && !r.URL.IsAbs() && pacPaths[r.URL.Path]
+}
+
+// servePAC answers a PAC request with the script of the listener's decision,
+// pointing clients back at the address they fetched it from.
+func (p *ProxyHandler) servePAC(w http.ResponseWriter, r *http.Request) {
+	listener, _ := r.Context().Value(listenerContextKey).(string)
+
+	p.mu.RLock()
+	script := p.decisionFor(listener).pacScript()
+	p.mu.RUnlock()
+
+	scheme := "PROXY"
+	if r.TLS != nil {
+		scheme = "HTTPS"
+	}
+
+	logger.Debug("Serving %s to %s", r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(w, "var proxy = %s;\n\n%s", jsString(scheme+" "+r.Host), script)
+}
+
+// pacScript returns the FindProxyForURL function of the decision, generated
+// once per config.
+func (d *ProxyDecision) pacScript() string {
+	d.pacOnce.Do(func() {
+		d.pac = generatePAC(d.config, d.rules, d.defaultProxy)
+	})
+	return d.pac
+}
+
+// generatePAC translates the rules into a PAC function. Only routes that are
+// certainly DIRECT are left to the client; everything else, blocking
+// included, goes to goProxy. The first rule PAC cannot express ends the
+// script, so that goProxy decides the remaining requests itself.
+func generatePAC(cfg *config.ProxyConfig, rules []config.RuleConfig, defaultProxy string) string {
+	var statements []pacStatement
+	final := pacAction(cfg, defaultProxy)
+
+	for _, rule := range rules {
+		condition, ok := pacCondition(rule)
+		if !ok {
+			ruleName := rule.Name
+			if ruleName == "" {
+				ruleName = "unnamed rule"
+			}
+			logger.Debug("Rule '%s' cannot be expressed in PAC, later requests go to the proxy", ruleName)
+			final = "proxy"
+			break
+		}
+		if rule.Not {
+			condition = "!(" + condition + ")"
+		}
+		statements = append(statements, pacStatement{condition: condition, action: pacAction(cfg, rule.Proxy)})
+	}
+
+	// Trailing rules that lead to the same place as the fallthrough can go.
+	for len(statements) > 0 && statements[len(statements)-1].action == final {
+		statements = statements[:len(statements)-1]
+	}
+
+	var sb strings.Builder
+	sb.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, statement := range statements {
+		fmt.Fprintf(&sb, "\tif (%s)\n\t\treturn %s;\n", statement.condition, statement.action)
+	}
+	fmt.Fprintf(&sb, "\treturn %s;\n}\n", final)
+	return sb.String()
+}
+
+func pacAction(cfg *config.ProxyConfig, proxyName string) string {
+	if proxyEntry, exists := cfg.Proxies[proxyName]; exists && proxyEntry.IsDirect() {
+		return `"DIRECT"`
+	}
+	return "proxy"
+}
+
+// pacCondition returns the PAC expression matching the same requests as the
+// rule, or false when the rule depends on something PAC cannot see: the
+// client, full URLs (browsers strip HTTPS URLs to the origin), hostnames in
+// ips, IPv6 networks or glob syntax beyond * and ?. Rules with more than
+// maxPACConditions hosts and networks are not expressed either.
+func pacCondition(rule config.RuleConfig) (string, bool) {
+	if len(rule.GetParsedUsers()) > 0 || len(rule.GetParsedSourceIps()) > 0 || len(rule.GetParsedURLs()) > 0 {
+		return "", false
+	}
+	if len(rule.GetParsedHosts())+len(rule.GetParsedIps()) > maxPACConditions {
+		return "", false
+	}
+
+	var conditions []string
+	for _, hostRule := range rule.GetParsedHosts() {
+		if strings.ContainsAny(hostRule, `[]{}\!`) {
+			return "", false
+		}
+		conditions = append(conditions, fmt.Sprintf("shExpMatch(host, %s)", jsString(hostRule)))
+	}
+
+	for _, ipRule := range rule.GetParsedIps() {
+		ipNet, ok := parseIPv4Net(ipRule)
+		if !ok {
+			return "", false
+		}
+		conditions = append(conditions, fmt.Sprintf("isInNet(host, %s, %s)",
+			jsString(ipNet.IP.String()), jsString(net.IP(ipNet.Mask).String())))
+	}
+
+	if len(conditions) == 0 {
+		return "false", true
+	}
+	return strings.Join(conditions, " ||\n\t    "), true
+}
+
+func parseIPv4Net(ipRule string) (*net.IPNet, bool) {
+	if !strings.Contains(ipRule, "/") {
+		ip := net.ParseIP(ipRule).To4()
+		if ip == nil {
+			return nil, false
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, true
+	}
+
+	_, ipNet, err := net.ParseCIDR(ipRule)
+	if err != nil || ipNet.IP.To4() == nil {
+		return nil, false
+	}
+	return ipNet, true
+}
+
+func jsString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
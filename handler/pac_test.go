@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fetchPAC returns the PAC file the handler serves for listener host.
+func fetchPAC(t *testing.T, handler *ProxyHandler) string {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+	request.Host = "proxy.lan:8080"
+	if !isPACRequest(request) {
+		t.Fatal("request for /proxy.pac is not a PAC request")
+	}
+	recorder := httptest.NewRecorder()
+	handler.servePAC(recorder, request)
+	return recorder.Body.String()
+}
+
+func TestPACScript(t *testing.T) {
+	handler := newTestHandler(t, `
+defaultProxy: upstream
+proxies:
+  upstream: "http://127.0.0.1:3128"
+rules:
+  - hosts: "*.lan"
+    proxy: direct
+  - hosts: "ads.example"
+    proxy: block
+  - ips: "10.0.0.0/8"
+    proxy: direct
+  - urls: "http://example.com/path"
+    proxy: direct
+  - hosts: "after.example"
+    proxy: direct
+`)
+	script := fetchPAC(t, handler)
+
+	for _, want := range []string{
+		`var proxy = "PROXY proxy.lan:8080";`,
+		`if (shExpMatch(host, "*.lan") ||`,
+		`if (isInNet(host, "10.0.0.0", "255.0.0.0"))` + "\n\t\treturn \"DIRECT\";",
+		`if (shExpMatch(host, "ads.example"))` + "\n\t\treturn proxy;",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script lacks %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "after.example") {
+		t.Errorf("rule after the urls rule is in the script:\n%s", script)
+	}
+	if !strings.HasSuffix(script, "\treturn proxy;\n}\n") {
+		t.Errorf("script does not end by going to the proxy:\n%s", script)
+	}
+}
+
+func TestPACScriptDropsTrailingDefaults(t *testing.T) {
+	handler := newTestHandler(t, `
+defaultProxy: direct
+rules:
+  - hosts: "*.internal"
+    proxy: direct
+`)
+	script := fetchPAC(t, handler)
+	if strings.Contains(script, "internal") || !strings.HasSuffix(script, "\treturn \"DIRECT\";\n}\n") {
+		t.Errorf("got:\n%s", script)
+	}
+}
+
+func TestPACScriptStopsAtBigRules(t *testing.T) {
+	var hosts strings.Builder
+	for i := 0; i <= maxPACConditions; i++ {
+		hosts.WriteString("      host" + strconv.Itoa(i) + ".example\n")
+	}
+	handler := newTestHandler(t, `
+defaultProxy: direct
+rules:
+  - hosts: "*.lan"
+    proxy: direct
+  - hosts: |
+`+hosts.String()+`    proxy: block
+  - hosts: "*.internal"
+    proxy: direct
+`)
+	script := fetchPAC(t, handler)
+
+	if !strings.Contains(script, `shExpMatch(host, "*.lan")`) {
+		t.Errorf("rule before the blocklist is missing:\n%s", script)
+	}
+	if strings.Contains(script, "host1.example") || strings.Contains(script, "internal") {
+		t.Errorf("blocklist or later rules are in the script:\n%s", script)
+	}
+	if !strings.HasSuffix(script, "\treturn proxy;\n}\n") {
+		t.Errorf("script does not leave the blocklist to the proxy:\n%s", script)
+	}
+}
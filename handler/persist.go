@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"goProxy/cache"
+	"goProxy/config"
+	"goProxy/logger"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// lookupCacheState is what is saved of the DNS and decision caches on
+// shutdown. Decisions are keyed by the hash of the rules that made them. DNS
+// answers, and the decisions of rule sets with IP rules, are only restored
+// for the same dns section and pinned hosts. The fake IP mapping is saved
+// when fakeIP.persist is set, and restored for the same range.
+type lookupCacheState struct {
+	DNSHash     string                   `json:"dnsHash"`
+	DNS         []cache.DNSRecord        `json:"dns,omitempty"`
+	Decisions   map[string]decisionState `json:"decisions,omitempty"`
+	FakeIPRange string                   `json:"fakeIPRange,omitempty"`
+	FakeIPs     []cache.FakeIPRecord     `json:"fakeIPs,omitempty"`
+}
+
+// decisionState holds the cached decisions of one rule set, least recently
+// used first.
+type decisionState struct {
+	Hosts []decisionRecord `json:"hosts,omitempty"`
+	URLs  []decisionRecord `json:"urls,omitempty"`
+	IPs   []decisionRecord `json:"ips,omitempty"`
+}
+
+type decisionRecord struct {
+	Key     string              `json:"key"`
+	Result  ProxyDecisionResult `json:"result"`
+	TTL     time.Duration       `json:"ttl,omitempty"`
+	Expires time.Time           `json:"expires,omitzero"`
+}
+
+// saveCaches writes the DNS cache and the decision caches to the lookup
+// cache file.
+func (p *ProxyHandler) saveCaches() {
+	state := lookupCacheState{
+		DNSHash:   dnsHash(p.decision.config),
+		DNS:       p.cache.DNSRecords(),
+		Decisions: make(map[string]decisionState),
+	}
+	for _, decision := range p.allDecisions() {
+		state.Decisions[decision.rulesHash()] = decision.state()
+	}
+	if cfg := p.decision.config; cfg.PersistFakeIPs() {
+		state.FakeIPRange = cfg.GetFakeIPRange().String()
+		state.FakeIPs = p.cache.FakeIPRecords()
+	}
+
+	path := config.GetLookupCachePath()
+	if err := writeLookupCache(path, &state); err != nil {
+		logger.Warn("Error saving lookup cache: %v", err)
+		return
+	}
+	logger.Debug("Saved %d DNS records to %s", len(state.DNS), path)
+}
+
+// loadCaches fills the DNS cache and the decision caches from the lookup
+// cache file, for the rule sets that did not change since it was saved.
+func (p *ProxyHandler) loadCaches() {
+	path := config.GetLookupCachePath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Error reading lookup cache: %v", err)
+		}
+		return
+	}
+
+	var state lookupCacheState
+	if err := json.Unmarshal(data, &state); err != nil {
+		logger.Warn("Ignoring invalid lookup cache %s: %v", path, err)
+		return
+	}
+
+	sameDNS := state.DNSHash == dnsHash(p.decision.config)
+	dnsRecords := 0
+	if sameDNS {
+		p.cache.RestoreDNSRecords(state.DNS)
+		dnsRecords = len(state.DNS)
+	}
+
+	if cfg := p.decision.config; cfg.PersistFakeIPs() && state.FakeIPRange == cfg.GetFakeIPRange().String() {
+		p.cache.RestoreFakeIPs(state.FakeIPs)
+		logger.Info("Restored %d fake IPs", len(state.FakeIPs))
+	}
+
+	restored := 0
+	for _, decision := range p.allDecisions() {
+		saved, exists := state.Decisions[decision.rulesHash()]
+		if exists && (sameDNS || !decision.hasIPRules()) {
+			decision.restore(saved)
+			restored++
+		}
+	}
+	logger.Info("Loaded lookup cache: %d DNS records, %d of %d rule sets unchanged",
+		dnsRecords, restored, len(p.allDecisions()))
+}
+
+func writeLookupCache(path string, state *lookupCacheState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// allDecisions returns the main decision and those of the listeners, each
+// once. The caller must hold p.mu.
+func (p *ProxyHandler) allDecisions() []*ProxyDecision {
+	decisions := []*ProxyDecision{p.decision}
+	seen := map[*ProxyDecision]bool{p.decision: true}
+	for _, decision := range p.listenerDecisions {
+		if !seen[decision] {
+			seen[decision] = true
+			decisions = append(decisions, decision)
+		}
+	}
+	return decisions
+}
+
+// adoptCaches hands the caches of the old decisions to the new ones with the
+// same rules, so that a reload does not start from empty caches. Rule sets
+// with IP rules start over when addresses may have changed. The caller must
+// hold p.mu.
+func (p *ProxyHandler) adoptCaches(old []*ProxyDecision, oldConfig *config.ProxyConfig) {
+	byHash := make(map[string]*ProxyDecision)
+	for _, decision := range old {
+		byHash[decision.rulesHash()] = decision
+	}
+
+	sameDNS := dnsHash(oldConfig) == dnsHash(p.decision.config)
+	for _, decision := range p.allDecisions() {
+		previous, exists := byHash[decision.rulesHash()]
+		if !exists || (!sameDNS && decision.hasIPRules()) {
+			continue
+		}
+		decision.hostCache = previous.hostCache
+		decision.urlCache = previous.urlCache
+		decision.ipCache = previous.ipCache
+		decision.nameCache = previous.nameCache
+	}
+}
+
+// rulesHash identifies everything the decisions depend on apart from DNS:
+// the rules with their external lists, and the default.
+func (d *ProxyDecision) rulesHash() string {
+	d.hashOnce.Do(func() {
+		h := sha256.New()
+		writeHashFields(h, d.defaultProxy, d.defaultRule)
+		for _, rule := range d.rules {
+			writeHashFields(h, rule.Name, rule.Proxy, fmt.Sprint(rule.Not))
+			for _, list := range [][]string{
+				rule.GetParsedURLs(), rule.GetParsedHosts(), rule.GetParsedIps(),
+				rule.GetParsedUsers(), rule.GetParsedSourceIps(),
+			} {
+				writeHashFields(h, strings.Join(list, "\n"))
+			}
+		}
+		d.hash = hex.EncodeToString(h.Sum(nil))
+	})
+	return d.hash
+}
+
+func (d *ProxyDecision) state() decisionState {
+	now := time.Now()
+	state := decisionState{
+		Hosts: decisionRecords(d.hostCache),
+		URLs:  decisionRecords(d.urlCache),
+	}
+	for _, key := range d.ipCache.Keys() {
+		cached, exists := d.ipCache.Peek(key)
+		if exists && now.Before(cached.expires) {
+			state.IPs = append(state.IPs, decisionRecord{Key: key, Result: cached.result, TTL: cached.ttl, Expires: cached.expires})
+		}
+	}
+	return state
+}
+
+func (d *ProxyDecision) restore(state decisionState) {
+	for _, record := range state.Hosts {
+		d.hostCache.Add(record.Key, record.Result)
+	}
+	for _, record := range state.URLs {
+		d.urlCache.Add(record.Key, record.Result)
+	}
+	now := time.Now()
+	for _, record := range state.IPs {
+		if now.Before(record.Expires) {
+			d.ipCache.Add(record.Key, ipDecision{result: record.Result, ttl: record.TTL, expires: record.Expires})
+		}
+	}
+}
+
+// hasIPRules reports whether decisions depend on the addresses of hosts.
+func (d *ProxyDecision) hasIPRules() bool {
+	for _, rule := range d.rules {
+		if len(rule.GetParsedIps()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func decisionRecords(c *lru.Cache[string, ProxyDecisionResult]) []decisionRecord {
+	var records []decisionRecord
+	for _, key := range c.Keys() {
+		if result, exists := c.Peek(key); exists {
+			records = append(records, decisionRecord{Key: key, Result: result})
+		}
+	}
+	return records
+}
+
+// dnsHash identifies the dns section, the dns servers including the
+// deprecated dnsUpstream, and the pinned hosts, which cached addresses and
+// ip decisions depend on.
+func dnsHash(cfg *config.ProxyConfig) string {
+	data, _ := json.Marshal(struct {
+		DNS     *config.DNSConfig
+		Servers []string
+		Hosts   map[string][]net.IP
+	}{cfg.DNS, cfg.GetDNSServers(), cfg.GetStaticHosts()})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeHashFields(h hash.Hash, fields ...string) {
+	for _, field := range fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"goProxy/cache"
+	"goProxy/config"
+)
+
+// startHandler loads YAML as the config in the profile directory dir and
+// returns a handler for it, which restores the caches saved there.
+func startHandler(t *testing.T, dir, yaml string) *ProxyHandler {
+	t.Helper()
+
+	t.Setenv("PROFILE_PLACE", dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml+"\nlogLevel: error\nlogFile: \"\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cacheManager := cache.NewCacheManager()
+	cfg, err := config.LoadConfig(path, cacheManager, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProxyHandler(cfg, cacheManager)
+}
+
+// hasDecision reports whether the main decision of handler has a cached
+// result for host.
+func hasDecision(handler *ProxyHandler, host string) bool {
+	state := handler.decision.state()
+	for _, records := range [][]decisionRecord{state.Hosts, state.IPs} {
+		for _, record := range records {
+			if strings.Contains(record.Key, host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCachesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	base := `
+defaultProxy: direct
+rules:
+  - hosts: "*.blocked"
+    proxy: block
+`
+	handler := startHandler(t, dir, base)
+	if _, result, err := handler.decisionFor("").GetProxyForAddr("ads.blocked:443", clientInfo{}); err != nil || result.Proxy != "block" {
+		t.Fatalf("decision = %v, %v", result, err)
+	}
+	handler.cache.RestoreDNSRecords([]cache.DNSRecord{
+		{Host: "resolved.example", IPs: []net.IP{net.ParseIP("192.0.2.1")}, TTL: time.Hour, Expires: time.Now().Add(time.Hour)},
+	})
+	handler.Close()
+
+	handler = startHandler(t, dir, base)
+	if !hasDecision(handler, "ads.blocked") {
+		t.Error("host decision not restored")
+	}
+	if _, ok := handler.cache.DNSExpiry("resolved.example"); !ok {
+		t.Error("DNS answer not restored")
+	}
+	handler.Close()
+
+	// Other DNS servers may answer otherwise; host rules do not care.
+	handler = startHandler(t, dir, base+"dns:\n  servers: [\"192.0.2.53\"]\n")
+	defer handler.Close()
+	if !hasDecision(handler, "ads.blocked") {
+		t.Error("host decision dropped for a dns change")
+	}
+	if _, ok := handler.cache.DNSExpiry("resolved.example"); ok {
+		t.Error("DNS answer restored for other DNS servers")
+	}
+}
+
+func TestIPDecisionsNeedTheSameDNS(t *testing.T) {
+	dir := t.TempDir()
+	base := `
+defaultProxy: direct
+hosts:
+  pinned.example: "192.0.2.1"
+rules:
+  - ips: "192.0.2.0/24"
+    proxy: block
+`
+	handler := startHandler(t, dir, base)
+	if _, result, err := handler.decisionFor("").GetProxyForAddr("pinned.example:443", clientInfo{}); err != nil || result.Proxy != "block" {
+		t.Fatalf("decision = %v, %v", result, err)
+	}
+	handler.Close()
+
+	handler = startHandler(t, dir, base)
+	restored := hasDecision(handler, "pinned.example")
+	handler.Close()
+	if !restored {
+		t.Error("decision not restored with the same dns section")
+	}
+
+	handler = startHandler(t, dir, base+"dns:\n  servers: [\"192.0.2.53\"]\n")
+	defer handler.Close()
+	if hasDecision(handler, "pinned.example") {
+		t.Error("IP rule decision restored for other DNS servers")
+	}
+}
+
+func TestReloadAdoptsCaches(t *testing.T) {
+	dir := t.TempDir()
+	yaml := `
+defaultProxy: direct
+rules:
+  - hosts: "*.blocked"
+    proxy: block
+`
+	handler := startHandler(t, dir, yaml)
+	defer handler.Close()
+	handler.decisionFor("").GetProxyForAddr("ads.blocked:443", clientInfo{})
+
+	cacheManager := cache.NewCacheManager()
+	cfg, err := config.LoadConfig(filepath.Join(dir, "config.yaml"), cacheManager, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.UpdateConfig(cfg, cacheManager)
+	if !hasDecision(handler, "ads.blocked") {
+		t.Error("reload with the same rules dropped the decisions")
+	}
+
+	os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yaml+"  - hosts: \"*.other\"\n    proxy: block\nlogLevel: error\nlogFile: \"\"\n"), 0644)
+	cfg, err = config.LoadConfig(filepath.Join(dir, "config.yaml"), cacheManager, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.UpdateConfig(cfg, cacheManager)
+	if hasDecision(handler, "ads.blocked") {
+		t.Error("decisions kept for changed rules")
+	}
+}
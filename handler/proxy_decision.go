@@ -5,44 +5,131 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"goProxy/cache"
 	"goProxy/config"
 	"goProxy/logger"
 
 	lru "github.com/hashicorp/golang-lru/v2"
-	explru "github.com/hashicorp/golang-lru/v2/expirable"
 )
 
 type ProxyDecisionResult struct {
 	Proxy     string
 	RuleName  string
-	MatchType string // "url", "host", "ip", or "default"
+	MatchType string // "url", "host", "ip", "client", or "default"
+}
+
+// ipPrefetchFraction is the part of its lifetime an ip decision has left
+// when a use refreshes it in the background: a tenth.
+const ipPrefetchFraction = 10
+
+// ipDecision is a decision made by an IP rule, valid as long as the addresses
+// it was made for.
+type ipDecision struct {
+	result  ProxyDecisionResult
+	ttl     time.Duration
+	expires time.Time
+}
+
+// clientInfo describes the inbound client a route is decided for.
+type clientInfo struct {
+	user string
+	ip   net.IP // nil for unix socket clients
 }
 
 type ProxyDecision struct {
-	config    *config.ProxyConfig
-	cache     *cache.CacheManager
-	hostCache *lru.Cache[string, ProxyDecisionResult]
-	urlCache  *lru.Cache[string, ProxyDecisionResult]
-	ipCache   *explru.LRU[string, ProxyDecisionResult]
+	config       *config.ProxyConfig
+	cache        *cache.CacheManager
+	rules        []config.RuleConfig
+	defaultProxy string
+	defaultRule  string
+	perClient    bool
+	hostCache    *lru.Cache[string, ProxyDecisionResult]
+	urlCache     *lru.Cache[string, ProxyDecisionResult]
+	ipCache      *lru.Cache[string, ipDecision]
+	nameCache    *lru.Cache[string, ProxyDecisionResult]
+
+	prefetching map[string]struct{} // ip decisions being refreshed
+	prefetchMu  sync.Mutex
+
+	hashOnce sync.Once
+	hash     string
+
+	pacOnce sync.Once
+	pac     string
 }
 
 func NewProxyDecision(config *config.ProxyConfig, cacheManager *cache.CacheManager) *ProxyDecision {
+	return newRuleDecision(config, cacheManager, config.Rules, config.DefaultProxy, "default")
+}
+
+// newListenerDecisions maps every listener to the decision it routes with:
+// the main one, one for its rule profile, or one forcing its proxy. Listeners
+// that select the same profile share its caches.
+func newListenerDecisions(cfg *config.ProxyConfig, cacheManager *cache.CacheManager, main *ProxyDecision) map[string]*ProxyDecision {
+	decisions := make(map[string]*ProxyDecision)
+	profiles := make(map[string]*ProxyDecision)
+
+	for _, listener := range cfg.GetListeners() {
+		switch {
+		case listener.Proxy != "":
+			decisions[listener.Name] = newRuleDecision(cfg, cacheManager, nil, listener.Proxy, "listener "+listener.Name)
+		case listener.Profile != "":
+			decision, exists := profiles[listener.Profile]
+			if !exists {
+				profile := cfg.Profiles[listener.Profile]
+				defaultProxy := profile.DefaultProxy
+				if defaultProxy == "" {
+					defaultProxy = cfg.DefaultProxy
+				}
+				decision = newRuleDecision(cfg, cacheManager, profile.Rules, defaultProxy, "default of profile "+listener.Profile)
+				profiles[listener.Profile] = decision
+			}
+			decisions[listener.Name] = decision
+		default:
+			decisions[listener.Name] = main
+		}
+	}
+
+	return decisions
+}
+
+func newRuleDecision(config *config.ProxyConfig, cacheManager *cache.CacheManager, rules []config.RuleConfig, defaultProxy, defaultRule string) *ProxyDecision {
 	hostCache, _ := lru.New[string, ProxyDecisionResult](1000)
 	urlCache, _ := lru.New[string, ProxyDecisionResult](1000)
-	ipCache := explru.NewLRU[string, ProxyDecisionResult](1000, nil, cache.IPResolutionTTL)
+	ipCache, _ := lru.New[string, ipDecision](1000)
+	nameCache, _ := lru.New[string, ProxyDecisionResult](1000)
 
 	return &ProxyDecision{
-		config:    config,
-		cache:     cacheManager,
-		hostCache: hostCache,
-		urlCache:  urlCache,
-		ipCache:   ipCache,
+		config:       config,
+		cache:        cacheManager,
+		rules:        rules,
+		defaultProxy: defaultProxy,
+		defaultRule:  defaultRule,
+		perClient:    hasClientRules(rules),
+		hostCache:    hostCache,
+		urlCache:     urlCache,
+		ipCache:      ipCache,
+		nameCache:    nameCache,
+		prefetching:  make(map[string]struct{}),
 	}
 }
 
+// hasClientRules reports whether a rule depends on the client, in which case
+// decisions are cached per client.
+func hasClientRules(rules []config.RuleConfig) bool {
+	for _, rule := range rules {
+		if len(rule.GetParsedUsers()) > 0 || len(rule.GetParsedSourceIps()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *ProxyDecision) matchesGlob(pattern, s string) bool {
 	hostWithoutPort := s
 	if strings.Contains(s, ":") {
@@ -64,6 +151,27 @@ func (d *ProxyDecision) matchesGlob(pattern, s string) bool {
 	return g.Match(hostWithoutPort)
 }
 
+// matchesSource reports whether the client IP is in one of the sourceIps of
+// a rule. Clients without an IP match none.
+func (d *ProxyDecision) matchesSource(sourceRules []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, sourceRule := range sourceRules {
+		ipNet, err := d.cache.GetCIDRNet(sourceRule)
+		if err != nil {
+			if d.config.ShouldLog(logger.LogLevelDebug) {
+				logger.Debug("Source rule '%s' is not a CIDR or IP, skipping", sourceRule)
+			}
+			continue
+		}
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *ProxyDecision) matchesURLPattern(pattern, url string) bool {
 	g, err := d.cache.GetGlob(pattern)
 	if err != nil {
@@ -73,19 +181,15 @@ func (d *ProxyDecision) matchesURLPattern(pattern, url string) bool {
 	return g.Match(url)
 }
 
-func (d *ProxyDecision) GetProxyForRequest(r *http.Request) (proxyURL string, decision ProxyDecisionResult, err error) {
+func (d *ProxyDecision) GetProxyForRequest(r *http.Request, client clientInfo) (proxyEntry *config.ProxyEntry, decision ProxyDecisionResult, err error) {
 	host := r.URL.Hostname()
 	fullURL := r.URL.String()
-	decision = d.getProxyDecision(host, fullURL)
-	var exists bool
-	proxyURL, exists = d.config.Proxies[decision.Proxy]
-	if !exists {
-		err = fmt.Errorf("proxy key '%s' not found in proxies map", decision.Proxy)
-	}
+	decision = d.getProxyDecision(host, fullURL, client)
+	proxyEntry, err = d.lookupProxy(decision.Proxy)
 	return
 }
 
-func (d *ProxyDecision) GetProxyForURL(urlStr string) (proxyURL string, parsedURL *url.URL, decision ProxyDecisionResult, err error) {
+func (d *ProxyDecision) GetProxyForURL(urlStr string) (proxyEntry *config.ProxyEntry, parsedURL *url.URL, decision ProxyDecisionResult, err error) {
 	parsedURL, err = url.Parse(urlStr)
 	if err != nil {
 		return
@@ -98,50 +202,150 @@ func (d *ProxyDecision) GetProxyForURL(urlStr string) (proxyURL string, parsedUR
 	host := parsedURL.Hostname()
 	fullURL := parsedURL.String()
 
-	decision = d.getProxyDecision(host, fullURL)
+	decision = d.getProxyDecision(host, fullURL, clientInfo{})
 
-	proxyURL = d.config.Proxies[decision.Proxy]
+	proxyEntry, err = d.lookupProxy(decision.Proxy)
 	return
 }
 
-func (d *ProxyDecision) getProxyDecision(host, fullURL string) ProxyDecisionResult {
-	if result, exists := d.urlCache.Get(fullURL); exists {
+// GetProxyForAddr decides the route of a raw connection to host:port, the
+// same way as for an HTTP CONNECT request to that address.
+func (d *ProxyDecision) GetProxyForAddr(addr string, client clientInfo) (proxyEntry *config.ProxyEntry, decision ProxyDecisionResult, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	fullURL := (&url.URL{Host: addr}).String()
+	decision = d.getProxyDecision(host, fullURL, client)
+	proxyEntry, err = d.lookupProxy(decision.Proxy)
+	return
+}
+
+// GetProxyForName decides the route of a hostname that is looked up rather
+// than connected to, as for DNS queries. Only host patterns are evaluated.
+func (d *ProxyDecision) GetProxyForName(host string, client clientInfo) (proxyEntry *config.ProxyEntry, decision ProxyDecisionResult, err error) {
+	key := d.cacheKey(host, client)
+	decision, exists := d.nameCache.Get(key)
+	if !exists {
+		decision = d.evaluateRules(host, "", client, true)
+		d.nameCache.Add(key, decision)
+	}
+	proxyEntry, err = d.lookupProxy(decision.Proxy)
+	return
+}
+
+func (d *ProxyDecision) lookupProxy(name string) (*config.ProxyEntry, error) {
+	proxyEntry, exists := d.config.Proxies[name]
+	if !exists {
+		return nil, fmt.Errorf("proxy key '%s' not found in proxies map", name)
+	}
+	return proxyEntry, nil
+}
+
+// cacheKey qualifies a cache key with the client when rules depend on it.
+func (d *ProxyDecision) cacheKey(key string, client clientInfo) string {
+	if !d.perClient {
+		return key
+	}
+	return client.user + "\x00" + client.ip.String() + "\x00" + key
+}
+
+func (d *ProxyDecision) getProxyDecision(host, fullURL string, client clientInfo) ProxyDecisionResult {
+	urlKey := d.cacheKey(fullURL, client)
+	hostKey := d.cacheKey(host, client)
+
+	if result, exists := d.urlCache.Get(urlKey); exists {
 		if d.config.ShouldLog(logger.LogLevelDebug) {
 			logger.Debug("URL cache hit for %s: proxy=%s, rule=%s", fullURL, result.Proxy, result.RuleName)
 		}
 		return result
 	}
 
-	if result, exists := d.hostCache.Get(host); exists {
+	if result, exists := d.hostCache.Get(hostKey); exists {
 		if d.config.ShouldLog(logger.LogLevelDebug) {
 			logger.Debug("Host cache hit for %s: proxy=%s, rule=%s", host, result.Proxy, result.RuleName)
 		}
 		return result
 	}
 
-	if result, exists := d.ipCache.Get(host); exists {
-		if d.config.ShouldLog(logger.LogLevelDebug) {
-			logger.Debug("IP cache hit for %s: proxy=%s, rule=%s", host, result.Proxy, result.RuleName)
+	if cached, exists := d.ipCache.Get(hostKey); exists {
+		if remaining := time.Until(cached.expires); remaining > 0 {
+			if d.config.ShouldLog(logger.LogLevelDebug) {
+				logger.Debug("IP cache hit for %s: proxy=%s, rule=%s", host, cached.result.Proxy, cached.result.RuleName)
+			}
+			if remaining < cached.ttl/ipPrefetchFraction {
+				d.prefetchIP(host, fullURL, client)
+			}
+			return cached.result
 		}
-		return result
 	}
 
-	result := d.evaluateRules(host, fullURL)
+	result := d.evaluateRules(host, fullURL, client, false)
+	d.addDecision(host, fullURL, client, result)
+	return result
+}
 
+func (d *ProxyDecision) addDecision(host, fullURL string, client clientInfo, result ProxyDecisionResult) {
 	switch result.MatchType {
 	case "url":
-		d.urlCache.Add(fullURL, result)
+		d.urlCache.Add(d.cacheKey(fullURL, client), result)
 	case "ip":
-		d.ipCache.Add(host, result)
+		expires := d.ipExpiry(host)
+		d.ipCache.Add(d.cacheKey(host, client), ipDecision{result: result, ttl: time.Until(expires), expires: expires})
 	default:
-		d.hostCache.Add(host, result)
+		d.hostCache.Add(d.cacheKey(host, client), result)
 	}
+}
 
-	return result
+// prefetchIP decides the route of host again in the background, with freshly
+// looked up addresses, before its ip decision expires.
+func (d *ProxyDecision) prefetchIP(host, fullURL string, client clientInfo) {
+	key := d.cacheKey(host, client)
+
+	d.prefetchMu.Lock()
+	if _, running := d.prefetching[key]; running {
+		d.prefetchMu.Unlock()
+		return
+	}
+	d.prefetching[key] = struct{}{}
+	d.prefetchMu.Unlock()
+
+	go func() {
+		defer func() {
+			d.prefetchMu.Lock()
+			delete(d.prefetching, key)
+			d.prefetchMu.Unlock()
+		}()
+
+		if d.config.ShouldLog(logger.LogLevelDebug) {
+			logger.Debug("Prefetching IP decision for %s", host)
+		}
+		if net.ParseIP(host) == nil {
+			d.cache.RefreshHost(host)
+		}
+		result := d.evaluateRules(host, fullURL, client, false)
+		if result.MatchType != "ip" {
+			d.ipCache.Remove(key)
+		}
+		d.addDecision(host, fullURL, client, result)
+	}()
+}
+
+// ipExpiry returns until when an IP rule decision for host holds: as long as
+// its addresses are cached, or IPResolutionTTL for IP literals.
+func (d *ProxyDecision) ipExpiry(host string) time.Time {
+	if expires, ok := d.cache.DNSExpiry(host); ok {
+		return expires
+	}
+	return time.Now().Add(cache.IPResolutionTTL)
 }
 
-func (d *ProxyDecision) evaluateRules(host, fullURL string) ProxyDecisionResult {
-	for _, rule := range d.config.Rules {
+// evaluateRules returns the result of the first matching rule. With hostOnly
+// the target is a bare name: urls and ips are unknown, so a rule can only
+// match on its hosts, and an inverted rule that has urls or ips not at all.
+func (d *ProxyDecision) evaluateRules(host, fullURL string, client clientInfo, hostOnly bool) ProxyDecisionResult {
+	for _, rule := range d.rules {
 		matchesRule := false
 		matchType := ""
 
@@ -149,6 +353,30 @@ func (d *ProxyDecision) evaluateRules(host, fullURL string) ProxyDecisionResult
 		ipRules := rule.GetParsedIps()
 		hostRules := rule.GetParsedHosts()
 
+		if hostOnly && (len(urlRules) > 0 || len(ipRules) > 0) {
+			if rule.Not || len(hostRules) == 0 {
+				continue
+			}
+			urlRules, ipRules = nil, nil
+		}
+
+		// users and sourceIps limit the clients a rule applies to; not only
+		// inverts the match of its urls, hosts and ips.
+		userRules := rule.GetParsedUsers()
+		if len(userRules) > 0 && !slices.Contains(userRules, client.user) {
+			continue
+		}
+		sourceRules := rule.GetParsedSourceIps()
+		if len(sourceRules) > 0 && !d.matchesSource(sourceRules, client.ip) {
+			continue
+		}
+		clientOnly := (len(userRules) > 0 || len(sourceRules) > 0) &&
+			len(urlRules) == 0 && len(hostRules) == 0 && len(ipRules) == 0
+		if clientOnly {
+			matchesRule = true
+			matchType = "client"
+		}
+
 		if len(urlRules) > 0 {
 			for _, urlRule := range urlRules {
 				if d.matchesURLPattern(urlRule, fullURL) {
@@ -237,7 +465,7 @@ func (d *ProxyDecision) evaluateRules(host, fullURL string) ProxyDecisionResult
 			ruleName = "unnamed rule"
 		}
 
-		if rule.Not {
+		if rule.Not && !clientOnly {
 			matchesRule = !matchesRule
 		}
 
@@ -251,8 +479,8 @@ func (d *ProxyDecision) evaluateRules(host, fullURL string) ProxyDecisionResult
 	}
 
 	return ProxyDecisionResult{
-		Proxy:     d.config.DefaultProxy,
-		RuleName:  "default",
+		Proxy:     d.defaultProxy,
+		RuleName:  d.defaultRule,
 		MatchType: "default",
 	}
 }
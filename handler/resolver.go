@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"reflect"
+
+	"goProxy/cache"
+	"goProxy/config"
+	"goProxy/logger"
+	"goProxy/resolver"
+)
+
+// applyResolvers installs the resolvers of the dns section: the one behind
+// CacheManager.ResolveHost, with the pinned hosts, and the one the DNS
+// listener forwards with, along with the fake IP range.
+// Cached addresses are dropped when the dns section changed.
+func (p *ProxyHandler) applyResolvers(old, cfg *config.ProxyConfig, cacheManager *cache.CacheManager) {
+	var dial resolver.DialFunc
+	if cfg.DNS != nil && cfg.DNS.Proxy != "" {
+		dial = p.proxyDialer(cfg.Proxies[cfg.DNS.Proxy])
+	}
+
+	servers := cfg.GetDNSServers()
+	var overrides map[string]string
+	if cfg.DNS != nil {
+		overrides = cfg.DNS.Overrides
+	}
+
+	var lookup cache.Resolver
+	if len(servers) > 0 || len(overrides) > 0 {
+		r, err := resolver.New(servers, overrides, dial)
+		if err != nil {
+			logger.Error("Invalid dns config, using the system resolver: %v", err)
+		} else {
+			lookup = r
+		}
+	}
+	cacheManager.SetResolver(lookup)
+	cacheManager.SetDNSTTLs(cfg.GetDNSTTLs())
+	cacheManager.SetStaticHosts(cfg.GetStaticHosts())
+	cacheManager.SetFakeIPRange(cfg.GetFakeIPRange(), cfg.GetFakeIPSize())
+
+	p.dnsForwarder = nil
+	if upstream := cfg.GetDNSUpstream(); upstream != "" {
+		servers = []string{upstream}
+	}
+	if len(servers) > 0 {
+		forwarder, err := resolver.New(servers, overrides, dial)
+		if err != nil {
+			logger.Error("Invalid DNS upstream: %v", err)
+		} else {
+			p.dnsForwarder = forwarder
+		}
+	}
+
+	if old != nil && (!reflect.DeepEqual(old.DNS, cfg.DNS) || !reflect.DeepEqual(old.GetDNSServers(), cfg.GetDNSServers())) {
+		cacheManager.ClearDNSCache()
+	}
+}
+
+// proxyDialer returns a dial function connecting through proxyEntry, for
+// queries to DNS servers that must not be sent directly.
+func (p *ProxyHandler) proxyDialer(proxyEntry *config.ProxyEntry) resolver.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx = context.WithValue(ctx, proxyContextKey, p.upstreams.order(proxyEntry))
+		return p.dialContext(ctx, network, addr)
+	}
+}
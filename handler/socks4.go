@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"goProxy/cache"
+)
+
+const (
+	socks4Version        = 0x04
+	socks4CommandConnect = 0x01
+	socks4Granted        = 0x5a
+	socks4Rejected       = 0x5b
+)
+
+// socks4Dialer opens tunnels through a SOCKS4 server. Hostnames are either
+// resolved locally, since SOCKS4 only carries IPv4 addresses, or sent to the
+// server using the SOCKS4a extension.
+type socks4Dialer struct {
+	proxyURL         *url.URL
+	resolveLocally   bool
+	handshakeTimeout time.Duration
+	cache            *cache.CacheManager
+	forward          contextDialer
+}
+
+func (d *socks4Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("SOCKS4 does not support network %s", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s: %w", portStr, err)
+	}
+
+	var ip net.IP
+	var hostname string
+	if parsedIP := net.ParseIP(host); parsedIP != nil {
+		ip = parsedIP.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("SOCKS4 does not support IPv6 address %s", host)
+		}
+	} else if d.resolveLocally {
+		ip, err = d.resolveIPv4(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// 0.0.0.1 tells a SOCKS4a server that a hostname follows the user ID.
+		ip = net.IPv4(0, 0, 0, 1).To4()
+		hostname = host
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", proxyHostPort(d.proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SOCKS4 proxy: %w", upstreamError(err))
+	}
+
+	req := []byte{socks4Version, socks4CommandConnect, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	req = append(req, ip...)
+	if d.proxyURL.User != nil {
+		req = append(req, d.proxyURL.User.Username()...)
+	}
+	req = append(req, 0)
+	if hostname != "" {
+		req = append(req, hostname...)
+		req = append(req, 0)
+	}
+
+	err = runHandshake(ctx, conn, d.handshakeTimeout, func() error {
+		if _, err := conn.Write(req); err != nil {
+			return fmt.Errorf("error sending SOCKS4 request: %w", err)
+		}
+
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("error reading SOCKS4 reply: %w", err)
+		}
+
+		switch reply[1] {
+		case socks4Granted:
+		case socks4Rejected:
+			// The server could not reach the destination or refuses it.
+			return &destinationError{err: fmt.Errorf("SOCKS4 request rejected with code %d", reply[1])}
+		default:
+			return fmt.Errorf("SOCKS4 request rejected with code %d", reply[1])
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *socks4Dialer) resolveIPv4(ctx context.Context, host string) (net.IP, error) {
+	ips, err := d.cache.ResolveHostContext(ctx, host)
+	if err != nil {
+		return nil, &destinationError{err: fmt.Errorf("error resolving %s for SOCKS4: %w", host, err)}
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return nil, &destinationError{err: fmt.Errorf("no IPv4 address found for %s", host)}
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"goProxy/cache"
+)
+
+// socks4Request is a CONNECT request as a SOCKS4 server received it.
+type socks4Request struct {
+	port     uint16
+	ip       net.IP
+	userID   string
+	hostname string
+}
+
+// socks4Server accepts one SOCKS4 request, answers it with code and returns
+// its address and the request it got.
+func socks4Server(t *testing.T, code byte) (string, <-chan socks4Request) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan socks4Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader, header); err != nil || header[0] != socks4Version || header[1] != socks4CommandConnect {
+			return
+		}
+		request := socks4Request{port: binary.BigEndian.Uint16(header[2:]), ip: net.IP(header[4:8])}
+		userID, err := reader.ReadString(0)
+		if err != nil {
+			return
+		}
+		request.userID = strings.TrimSuffix(userID, "\x00")
+		if request.ip.Equal(net.IPv4(0, 0, 0, 1)) {
+			hostname, err := reader.ReadString(0)
+			if err != nil {
+				return
+			}
+			request.hostname = strings.TrimSuffix(hostname, "\x00")
+		}
+		requests <- request
+
+		conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		if code == socks4Granted {
+			io.Copy(io.Discard, reader)
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func newSocks4Dialer(t *testing.T, rawURL string, resolveLocally bool) *socks4Dialer {
+	t.Helper()
+
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheManager := cache.NewCacheManager()
+	cacheManager.SetStaticHosts(map[string][]net.IP{
+		"pinned.example": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.7")},
+		"v6only.example": {net.ParseIP("2001:db8::2")},
+	})
+	return &socks4Dialer{
+		proxyURL:       proxyURL,
+		resolveLocally: resolveLocally,
+		cache:          cacheManager,
+		forward:        &net.Dialer{},
+	}
+}
+
+func TestSocks4Dialer(t *testing.T) {
+	tests := []struct {
+		name           string
+		scheme         string
+		user           string
+		resolveLocally bool
+		addr           string
+		want           socks4Request
+	}{
+		{"address with user ID", "socks4", "alice@", false, "192.0.2.1:80",
+			socks4Request{port: 80, ip: net.IPv4(192, 0, 2, 1), userID: "alice"}},
+		{"hostname resolved locally", "socks4", "", true, "pinned.example:443",
+			socks4Request{port: 443, ip: net.IPv4(192, 0, 2, 7)}},
+		{"hostname sent with SOCKS4a", "socks4a", "", false, "remote.example:8080",
+			socks4Request{port: 8080, ip: net.IPv4(0, 0, 0, 1), hostname: "remote.example"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, requests := socks4Server(t, socks4Granted)
+			dialer := newSocks4Dialer(t, tt.scheme+"://"+tt.user+addr, tt.resolveLocally)
+
+			conn, err := dialer.DialContext(context.Background(), "tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			got := <-requests
+			if got.port != tt.want.port || !got.ip.Equal(tt.want.ip) || got.userID != tt.want.userID || got.hostname != tt.want.hostname {
+				t.Errorf("server got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSocks4DialerRejected(t *testing.T) {
+	for _, code := range []byte{0x5b, 0x5c, 0x5d} {
+		t.Run(strconv.Itoa(int(code)), func(t *testing.T) {
+			addr, _ := socks4Server(t, code)
+			dialer := newSocks4Dialer(t, "socks4://"+addr, true)
+
+			_, err := dialer.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+			if err == nil || !strings.Contains(err.Error(), "code "+strconv.Itoa(int(code))) {
+				t.Errorf("err = %v, want the rejection with code %d", err, code)
+			}
+		})
+	}
+}
+
+func TestSocks4DialerRefusesWhatSOCKS4CannotCarry(t *testing.T) {
+	dialer := newSocks4Dialer(t, "socks4://"+deadAddr(t), true)
+
+	for _, addr := range []string{"[2001:db8::1]:80", "v6only.example:80"} {
+		if _, err := dialer.DialContext(context.Background(), "tcp", addr); err == nil {
+			t.Errorf("dial to %s succeeded", addr)
+		}
+	}
+	if _, err := dialer.DialContext(context.Background(), "udp", "192.0.2.1:53"); err == nil {
+		t.Error("UDP dial succeeded")
+	}
+}
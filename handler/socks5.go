@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	socks5PasswordVersion  = 0x01
+	socks5CommandConnect   = 0x01
+	socks5CommandUDP       = 0x03
+	socks5AddrIPv4         = 0x01
+	socks5AddrDomain       = 0x03
+	socks5AddrIPv6         = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyNetworkUnreachable  = 0x03
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyConnectionRefused   = 0x05
+	socks5ReplyTTLExpired          = 0x06
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddrNotSupported    = 0x08
+)
+
+var errSocks5AddrNotSupported = errors.New("unsupported SOCKS5 address type")
+
+// socks5ReplyError is a request a SOCKS5 server answered with a failure.
+type socks5ReplyError struct {
+	code byte
+}
+
+func (e *socks5ReplyError) Error() string {
+	return fmt.Sprintf("SOCKS5 request failed with code %d", e.code)
+}
+
+// aboutDestination reports whether the server failed to reach the
+// destination, rather than failing itself.
+func (e *socks5ReplyError) aboutDestination() bool {
+	switch e.code {
+	case socks5ReplyNotAllowed, socks5ReplyNetworkUnreachable, socks5ReplyHostUnreachable,
+		socks5ReplyConnectionRefused, socks5ReplyTTLExpired:
+		return true
+	}
+	return false
+}
+
+// socks5Dialer opens tunnels through a SOCKS5 server, authenticating with
+// the username and password of the proxy URL when present.
+type socks5Dialer struct {
+	proxyURL         *url.URL
+	handshakeTimeout time.Duration
+	forward          contextDialer
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("SOCKS5 does not support network %s", network)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", proxyHostPort(d.proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SOCKS5 proxy: %w", upstreamError(err))
+	}
+
+	err = runHandshake(ctx, conn, d.handshakeTimeout, func() error {
+		_, err := socks5Handshake(conn, d.proxyURL.User, socks5CommandConnect, addr)
+		var replyErr *socks5ReplyError
+		if errors.As(err, &replyErr) && replyErr.aboutDestination() {
+			return &destinationError{err: err}
+		}
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// socks5Handshake negotiates authentication and sends a request with the
+// given command, returning the address bound by the server.
+func socks5Handshake(conn net.Conn, user *url.Userinfo, command byte, addr string) (string, error) {
+	methods := []byte{socks5AuthNone}
+	if user != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return "", fmt.Errorf("error sending SOCKS5 greeting: %w", err)
+	}
+
+	choice := make([]byte, 2)
+	if _, err := io.ReadFull(conn, choice); err != nil {
+		return "", fmt.Errorf("error reading SOCKS5 greeting reply: %w", err)
+	}
+	if choice[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d", choice[0])
+	}
+
+	switch choice[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if user == nil {
+			return "", fmt.Errorf("SOCKS5 server requires authentication")
+		}
+		if err := socks5Authenticate(conn, user); err != nil {
+			return "", err
+		}
+	case socks5AuthNoAcceptable:
+		return "", fmt.Errorf("SOCKS5 server accepts none of the offered authentication methods")
+	default:
+		return "", fmt.Errorf("SOCKS5 server chose unsupported authentication method %d", choice[1])
+	}
+
+	req := []byte{socks5Version, command, 0}
+	req, err := appendSocks5Addr(req, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", fmt.Errorf("error sending SOCKS5 request: %w", err)
+	}
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", fmt.Errorf("error reading SOCKS5 reply: %w", err)
+	}
+	if reply[1] != socks5ReplySucceeded {
+		return "", &socks5ReplyError{code: reply[1]}
+	}
+
+	boundAddr, err := readSocks5Addr(conn)
+	if err != nil {
+		return "", fmt.Errorf("error reading SOCKS5 bound address: %w", err)
+	}
+
+	return boundAddr, nil
+}
+
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("SOCKS5 username or password too long")
+	}
+
+	req := []byte{socks5PasswordVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("error sending SOCKS5 credentials: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("error reading SOCKS5 authentication reply: %w", err)
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("SOCKS5 authentication failed")
+	}
+
+	return nil
+}
+
+// appendSocks5Addr encodes host:port as a SOCKS5 address, using the domain
+// form for hostnames.
+func appendSocks5Addr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s: %w", portStr, err)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AddrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname too long: %s", host)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocks5Addr reads an address type, address and port and returns them
+// as host:port.
+func readSocks5Addr(r io.Reader) (string, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch addrType[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if addrType[0] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("%w %d", errSocks5AddrNotSupported, addrType[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
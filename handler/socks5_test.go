@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// recordingSocks5Server accepts SOCKS5 CONNECT requests without
+// authentication, sends their target to targets and answers them with a
+// tunnel to reachable.
+func recordingSocks5Server(t *testing.T, reachable string, targets chan<- string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{socks5Version, socks5AuthNone})
+
+				request := make([]byte, 3)
+				if _, err := io.ReadFull(conn, request); err != nil {
+					return
+				}
+				addr, err := readSocks5Addr(conn)
+				if err != nil {
+					return
+				}
+				targets <- addr
+
+				target, err := net.Dial("tcp", reachable)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				reply, _ := appendSocks5Addr([]byte{socks5Version, socks5ReplySucceeded, 0}, "0.0.0.0:0")
+				conn.Write(reply)
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSocks5Resolve(t *testing.T) {
+	target := echoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	targets := make(chan string, 1)
+	socksAddr := recordingSocks5Server(t, target, targets)
+
+	tests := []struct {
+		name    string
+		scheme  string
+		resolve string
+		want    string
+	}{
+		{"socks5 resolves locally", "socks5", "", "127.0.0.1"},
+		{"socks5h lets the server resolve", "socks5h", "", "pinned.example"},
+		{"socks5 with remote resolve", "socks5", "remote", "pinned.example"},
+		{"socks5h with local resolve", "socks5h", "local", "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+hosts:
+  pinned.example: "127.0.0.1"
+proxies:
+  upstream:
+    urls: ["%s://%s"]
+    resolve: %q
+rules: []
+`, tt.scheme, socksAddr, tt.resolve))
+			entry := handler.decision.config.Proxies["upstream"]
+
+			conn, err := handler.dialUpstream(context.Background(), entry, entry.URLs[0], "tcp", net.JoinHostPort("pinned.example", port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			if got := <-targets; got != net.JoinHostPort(tt.want, port) {
+				t.Errorf("server was asked for %s, want %s", got, net.JoinHostPort(tt.want, port))
+			}
+		})
+	}
+}
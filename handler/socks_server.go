@@ -0,0 +1,399 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"goProxy/logger"
+)
+
+// ErrSocksServerClosed is returned by ListenAndServe after Close.
+var ErrSocksServerClosed = errors.New("socks: server closed")
+
+// SocksServer accepts SOCKS5 clients and routes their connections with the
+// same rules and upstreams as the HTTP proxy.
+type SocksServer struct {
+	Addr     string
+	listener string
+	handler  *ProxyHandler
+
+	netListener net.Listener
+	conns       map[net.Conn]struct{}
+	closed      bool
+	mu          sync.Mutex
+}
+
+// NewSocksServer returns a server for the named listener, which routes with
+// the rules selected for that listener.
+func NewSocksServer(name, addr string, handler *ProxyHandler) *SocksServer {
+	return &SocksServer{
+		Addr:     addr,
+		listener: name,
+		handler:  handler,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *SocksServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts clients on listener until Close is called, and closes it.
+func (s *SocksServer) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrSocksServerClosed
+	}
+	s.netListener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrSocksServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrSocksServerClosed
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops accepting clients and closes all active connections.
+func (s *SocksServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	if s.netListener != nil {
+		err = s.netListener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *SocksServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *SocksServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+func (s *SocksServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	config := s.handler.currentConfig()
+	conn.SetDeadline(time.Now().Add(config.GetHandshakeTimeout()))
+
+	s.handler.mu.RLock()
+	auth := s.handler.auth
+	acl := s.handler.acl
+	s.handler.mu.RUnlock()
+
+	clientIP := remoteIP(conn.RemoteAddr())
+	if !acl.allows(clientIP) {
+		logger.Warn("Refusing SOCKS5 client %s", conn.RemoteAddr())
+		return
+	}
+
+	user, err := socks5AcceptAuth(conn, auth.required, auth.check)
+	if err != nil {
+		logger.Warn("SOCKS5 handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	client := clientInfo{user: user, ip: clientIP}
+
+	command, addr, err := readSocks5Request(conn)
+	if err != nil {
+		if errors.Is(err, errSocks5AddrNotSupported) {
+			writeSocks5Reply(conn, socks5ReplyAddrNotSupported, "")
+		}
+		logger.Warn("Error reading SOCKS5 request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	// The timeouts of the selected upstream bound the dial from here on.
+	conn.SetDeadline(time.Time{})
+
+	if config.ShouldLog(logger.LogLevelDebug) {
+		logger.Debug("SOCKS5 command %d to %s from %s", command, addr, conn.RemoteAddr())
+	}
+
+	switch command {
+	case socks5CommandConnect:
+		s.handleConnect(conn, addr, client)
+	case socks5CommandUDP:
+		s.handleUDPAssociate(conn, client)
+	default:
+		writeSocks5Reply(conn, socks5ReplyCommandNotSupported, "")
+	}
+}
+
+func (s *SocksServer) handleConnect(conn net.Conn, addr string, client clientInfo) {
+	p := s.handler
+
+	addr, err := p.unmapFakeIP(addr)
+	if err != nil {
+		logger.Warn("Rejecting SOCKS5 CONNECT: %v", err)
+		writeSocks5Reply(conn, socks5ReplyHostUnreachable, "")
+		return
+	}
+
+	p.mu.RLock()
+	proxyEntry, decisionResult, err := p.decisionFor(s.listener).GetProxyForAddr(addr, client)
+	p.mu.RUnlock()
+
+	if err != nil {
+		logger.Error("Error getting proxy decision: %v", err)
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, "")
+		return
+	}
+
+	if proxyEntry.IsBlock() {
+		logger.Info("Blocking SOCKS5 CONNECT to %s (rule: '%s', proxy: '%s')", addr, decisionResult.RuleName, decisionResult.Proxy)
+		writeSocks5Reply(conn, socks5ReplyNotAllowed, "")
+		return
+	}
+
+	selection := p.upstreams.order(proxyEntry)
+	logRoute("SOCKS5 CONNECT", addr, selection, decisionResult)
+
+	ctx, stopWatch := watchClient(conn)
+	ctx = context.WithValue(ctx, proxyContextKey, selection)
+	upstream, err := p.dialContext(ctx, "tcp", addr)
+	conn = stopWatch()
+	if err != nil {
+		logger.Warn("SOCKS5 CONNECT to %s failed: %v", addr, err)
+		writeSocks5Reply(conn, socks5DialErrorReply(err), "")
+		return
+	}
+	defer upstream.Close()
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, upstream.LocalAddr().String()); err != nil {
+		return
+	}
+
+	relay(conn, upstream)
+}
+
+// socks5AcceptAuth negotiates the authentication method with a client,
+// requiring a username and password checked by check when required. It
+// returns the authenticated username.
+func socks5AcceptAuth(conn net.Conn, required bool, check func(username, password string) bool) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("error reading greeting: %w", err)
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("error reading authentication methods: %w", err)
+	}
+
+	method := byte(socks5AuthNone)
+	if required {
+		method = socks5AuthPassword
+	}
+
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", fmt.Errorf("client offered no acceptable authentication method")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+
+	if method == socks5AuthPassword {
+		return socks5CheckPassword(conn, check)
+	}
+	return "", nil
+}
+
+func socks5CheckPassword(conn net.Conn, check func(username, password string) bool) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("error reading credentials: %w", err)
+	}
+	if header[0] != socks5PasswordVersion {
+		return "", fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", fmt.Errorf("error reading credentials: %w", err)
+	}
+
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return "", fmt.Errorf("error reading credentials: %w", err)
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", fmt.Errorf("error reading credentials: %w", err)
+	}
+
+	if !check(string(username), string(password)) {
+		conn.Write([]byte{socks5PasswordVersion, 1})
+		return "", fmt.Errorf("authentication failed for user '%s'", username)
+	}
+
+	_, err := conn.Write([]byte{socks5PasswordVersion, 0})
+	return string(username), err
+}
+
+// readSocks5Request reads the command and destination address of a client request.
+func readSocks5Request(conn net.Conn) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks5Version {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	addr, err := readSocks5Addr(conn)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return header[1], addr, nil
+}
+
+// writeSocks5Reply sends a reply with the bound address, or the unspecified
+// address when boundAddr is empty.
+func writeSocks5Reply(conn net.Conn, code byte, boundAddr string) error {
+	if boundAddr == "" {
+		boundAddr = "0.0.0.0:0"
+	}
+
+	reply, err := appendSocks5Addr([]byte{socks5Version, code, 0}, boundAddr)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(reply)
+	return err
+}
+
+func socks5DialErrorReply(err error) byte {
+	var replyErr *socks5ReplyError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &replyErr) && replyErr.aboutDestination():
+		return replyErr.code
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyConnectionRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5ReplyHostUnreachable
+	default:
+		return socks5ReplyGeneralFailure
+	}
+}
+
+// watchClient returns a context cancelled when the client closes conn, so
+// that dialing the upstream is aborted once nobody waits for it. stop ends
+// the watch and returns conn, with any data the client sent meanwhile still
+// to be read.
+func watchClient(conn net.Conn) (ctx context.Context, stop func() net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var early [1]byte
+	var n int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		n, err = conn.Read(early[:])
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+
+	return ctx, func() net.Conn {
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		cancel()
+		conn.SetReadDeadline(time.Time{})
+
+		if n == 0 {
+			return conn
+		}
+		reader := bufio.NewReader(io.MultiReader(bytes.NewReader(early[:n]), conn))
+		return &bufferedConn{Conn: conn, reader: reader}
+	}
+}
+
+// relay copies data in both directions until both sides are done, passing
+// on half-closes so request/response protocols finish cleanly.
+func relay(client, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, client)
+		closeWrite(upstream)
+	}()
+
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+
+	wg.Wait()
+}
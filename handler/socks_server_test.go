@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startSocksServer serves the SOCKS5 listener of handler on a local port and
+// returns its address.
+func startSocksServer(t *testing.T, handler *ProxyHandler) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSocksServer("", listener.Addr().String(), handler)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return listener.Addr().String()
+}
+
+// socks5Client returns a dialer that connects through the SOCKS5 server at
+// addr.
+func socks5Client(addr string) *socks5Dialer {
+	return &socks5Dialer{
+		proxyURL: &url.URL{Scheme: "socks5", Host: addr},
+		forward:  &net.Dialer{},
+	}
+}
+
+// echoServer returns the address of a TCP server that writes back what it
+// reads.
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSocksConnect(t *testing.T) {
+	handler := newTestHandler(t, `
+defaultProxy: direct
+proxies:
+  direct: ""
+rules:
+  - hosts: "blocked.example"
+    proxy: block
+`)
+	socksAddr := startSocksServer(t, handler)
+	target := echoServer(t)
+
+	conn, err := socks5Client(socksAddr).DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("got %q, %v through the tunnel", reply, err)
+	}
+
+	_, err = socks5Client(socksAddr).DialContext(context.Background(), "tcp", "blocked.example:80")
+	if err == nil {
+		t.Fatal("CONNECT to a blocked host succeeded")
+	}
+}
+
+// TestSocksConnectAbortsDial checks that a client leaving while its upstream
+// is dialled stops the dial.
+func TestSocksConnectAbortsDial(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	// The upstream accepts the connection but never answers the CONNECT.
+	aborted := make(chan struct{})
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		close(aborted)
+	}()
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: hanging
+timeouts:
+  handshakeSeconds: 60
+proxies:
+  hanging: "http://%s"
+rules: []
+`, upstream.Addr()))
+	socksAddr := startSocksServer(t, handler)
+
+	client, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte{socks5Version, 1, socks5AuthNone})
+	if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	request, _ := appendSocks5Addr([]byte{socks5Version, socks5CommandConnect, 0}, "192.0.2.1:80")
+	client.Write(request)
+
+	// Leave once the upstream is being dialled.
+	time.Sleep(100 * time.Millisecond)
+	client.Close()
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream connection still open after the client left")
+	}
+}
+
+// TestSocksConnectOutlastsHandshakeTimeout checks that the client handshake
+// timeout does not cut short an upstream allowed to take longer.
+func TestSocksConnectOutlastsHandshakeTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		connectProxyServer(w, r)
+	}))
+	defer slow.Close()
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: slow
+timeouts:
+  handshakeSeconds: 1
+proxies:
+  slow:
+    urls: ["%s"]
+    timeouts:
+      handshakeSeconds: 5
+rules: []
+`, slow.URL))
+	socksAddr := startSocksServer(t, handler)
+
+	conn, err := socks5Client(socksAddr).DialContext(context.Background(), "tcp", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("got %q, %v through the tunnel", reply, err)
+	}
+}
+
+func TestSocksAuthentication(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "htpasswd")
+	// SHA-1 of "secret".
+	if err := os.WriteFile(authFile, []byte("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: direct
+authFile: %q
+rules: []
+`, authFile))
+	socksAddr := startSocksServer(t, handler)
+	target := echoServer(t)
+
+	tests := []struct {
+		name string
+		user *url.Userinfo
+		ok   bool
+	}{
+		{"valid credentials", url.UserPassword("alice", "secret"), true},
+		{"wrong password", url.UserPassword("alice", "guess"), false},
+		{"unknown user", url.UserPassword("bob", "secret"), false},
+		{"no credentials", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := socks5Client(socksAddr)
+			client.proxyURL.User = tt.user
+
+			conn, err := client.DialContext(context.Background(), "tcp", target)
+			if err == nil {
+				conn.Close()
+			}
+			if tt.ok && err != nil {
+				t.Errorf("CONNECT failed: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("CONNECT succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,488 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"goProxy/config"
+	"goProxy/logger"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+const maxUDPPacketSize = 65535
+
+// maxUDPDestinations is the number of destinations an association keeps the
+// route and fake IP address of; the least recently used ones are routed
+// again when the client returns to them.
+const maxUDPDestinations = 1024
+
+// maxPendingDatagrams is the number of datagrams kept per destination while
+// it is being routed; later ones are dropped.
+const maxPendingDatagrams = 16
+
+var errUDPNotSupported = errors.New("UDP is only supported direct or through a single SOCKS5 upstream")
+
+// udpSocket sends datagrams on behalf of a SOCKS5 client, either straight to
+// their destination or to the UDP relay of an upstream SOCKS5 server. With a
+// relay the datagrams keep their SOCKS5 header in both directions.
+type udpSocket struct {
+	conn           *net.UDPConn
+	relayAddr      *net.UDPAddr
+	control        net.Conn
+	resolveLocally bool
+}
+
+// udpDatagram is a datagram from the client waiting for its destination to
+// be routed.
+type udpDatagram struct {
+	fakeAddr string
+	payload  []byte
+}
+
+// udpAssociation relays the datagrams of one UDP ASSOCIATE request. Every
+// destination is routed once through the rules, off the loop reading the
+// client, and the association ends with the TCP connection that requested
+// it. fakeAddrs maps the addresses datagrams were sent to back to the fake
+// IP addresses the client used.
+type udpAssociation struct {
+	handler  *ProxyHandler
+	listener string
+	source   clientInfo
+	client   *net.UDPConn
+	clientIP net.IP
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	clientAddr *net.UDPAddr
+	sockets    map[string]*udpSocket
+	routes     *simplelru.LRU[string, *udpSocket]
+	pending    map[string][]udpDatagram
+	fakeAddrs  *simplelru.LRU[string, string]
+	closed     bool
+	mu         sync.Mutex
+}
+
+func (s *SocksServer) handleUDPAssociate(conn net.Conn, source clientInfo) {
+	localAddr, isTCP := conn.LocalAddr().(*net.TCPAddr)
+	if !isTCP {
+		writeSocks5Reply(conn, socks5ReplyCommandNotSupported, "")
+		return
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		logger.Error("Error opening UDP relay: %v", err)
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, "")
+		return
+	}
+
+	routes, _ := simplelru.NewLRU[string, *udpSocket](maxUDPDestinations, nil)
+	fakeAddrs, _ := simplelru.NewLRU[string, string](maxUDPDestinations, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	association := &udpAssociation{
+		handler:   s.handler,
+		listener:  s.listener,
+		source:    source,
+		client:    client,
+		clientIP:  conn.RemoteAddr().(*net.TCPAddr).IP,
+		ctx:       ctx,
+		cancel:    cancel,
+		sockets:   make(map[string]*udpSocket),
+		routes:    routes,
+		pending:   make(map[string][]udpDatagram),
+		fakeAddrs: fakeAddrs,
+	}
+	defer association.close()
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, client.LocalAddr().String()); err != nil {
+		return
+	}
+
+	logger.Info("UDP relay on %s for %s", client.LocalAddr(), conn.RemoteAddr())
+	go association.serve()
+
+	io.Copy(io.Discard, conn)
+}
+
+func (a *udpAssociation) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := a.client.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) {
+			continue
+		}
+
+		a.mu.Lock()
+		a.clientAddr = from
+		a.mu.Unlock()
+
+		a.forward(buf[:n])
+	}
+}
+
+// forward sends a datagram from the client to its destination. Datagrams to
+// a destination that is not routed yet wait for route, which runs in its own
+// goroutine so that other destinations are not held up.
+func (a *udpAssociation) forward(packet []byte) {
+	// RSV(2) FRAG(1), fragmented datagrams are not supported.
+	if len(packet) < 4 || packet[2] != 0 {
+		return
+	}
+
+	reader := bytes.NewReader(packet[3:])
+	addr, err := readSocks5Addr(reader)
+	if err != nil {
+		return
+	}
+	payload := packet[len(packet)-reader.Len():]
+
+	fakeAddr := addr
+	addr, err = a.handler.unmapFakeIP(addr)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	socket, routed := a.routes.Get(addr)
+	if !routed {
+		queued, routing := a.pending[addr]
+		if len(queued) < maxPendingDatagrams {
+			a.pending[addr] = append(queued, udpDatagram{fakeAddr: fakeAddr, payload: bytes.Clone(payload)})
+		}
+		a.mu.Unlock()
+		if !routing {
+			go a.route(addr)
+		}
+		return
+	}
+	a.mu.Unlock()
+
+	a.send(socket, addr, fakeAddr, payload)
+}
+
+// send passes a datagram to addr on socket, a nil socket dropping it.
+func (a *udpAssociation) send(socket *udpSocket, addr, fakeAddr string, payload []byte) {
+	if socket == nil {
+		return
+	}
+
+	if socket.relayAddr != nil {
+		if socket.resolveLocally {
+			addr = a.resolve(addr)
+		}
+		header, err := appendSocks5Addr([]byte{0, 0, 0}, addr)
+		if err != nil {
+			return
+		}
+		a.rememberFakeAddr(addr, fakeAddr)
+		socket.conn.WriteToUDP(append(header, payload...), socket.relayAddr)
+		return
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", a.resolve(addr))
+	if err != nil {
+		return
+	}
+	a.rememberFakeAddr(net.JoinHostPort(udpAddr.IP.String(), strconv.Itoa(udpAddr.Port)), fakeAddr)
+	socket.conn.WriteToUDP(payload, udpAddr)
+}
+
+// rememberFakeAddr notes that datagrams to addr were sent to fakeAddr by the
+// client, which expects replies to come from there.
+func (a *udpAssociation) rememberFakeAddr(addr, fakeAddr string) {
+	if fakeAddr == addr {
+		return
+	}
+	a.mu.Lock()
+	a.fakeAddrs.Add(addr, fakeAddr)
+	a.mu.Unlock()
+}
+
+// replyAddr returns the address a reply from addr is reported to come from.
+func (a *udpAssociation) replyAddr(addr string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if fakeAddr, exists := a.fakeAddrs.Get(addr); exists {
+		return fakeAddr
+	}
+	return addr
+}
+
+// route finds the socket for datagrams to addr, nil when they are dropped,
+// and sends the datagrams that waited for it.
+func (a *udpAssociation) route(addr string) {
+	var socket *udpSocket
+
+	p := a.handler
+	p.mu.RLock()
+	proxyEntry, decisionResult, err := p.decisionFor(a.listener).GetProxyForAddr(addr, a.source)
+	p.mu.RUnlock()
+
+	if err != nil {
+		logger.Error("Error getting proxy decision: %v", err)
+	} else if proxyEntry.IsBlock() {
+		logger.Info("Blocking UDP to %s (rule: '%s', proxy: '%s')", addr, decisionResult.RuleName, decisionResult.Proxy)
+	} else {
+		selection := p.upstreams.order(proxyEntry)
+		logRoute("UDP", addr, selection, decisionResult)
+		socket = a.open(selection, addr)
+	}
+
+	a.mu.Lock()
+	a.routes.Add(addr, socket)
+	queued := a.pending[addr]
+	delete(a.pending, addr)
+	a.mu.Unlock()
+
+	for _, datagram := range queued {
+		a.send(socket, addr, datagram.fakeAddr, datagram.payload)
+	}
+}
+
+// open returns a socket for the first member of the selection that can
+// carry UDP, trying the others in order like dialContext does.
+func (a *udpAssociation) open(selection upstreamSelection, addr string) *udpSocket {
+	proxyEntry := selection.entry
+	for _, proxyURL := range selection.urls {
+		socket, err := a.socket(proxyEntry, proxyURL)
+		if err == nil {
+			return socket
+		}
+
+		logger.Warn("UDP to %s via %s failed: %v", addr, describeUpstream(proxyURL), err)
+		if proxyEntry.IsGroup() && !errors.Is(err, errUDPNotSupported) {
+			a.handler.upstreams.markFailed(proxyURL, proxyEntry.GetCooldown())
+		}
+	}
+	return nil
+}
+
+func (a *udpAssociation) socket(proxyEntry *config.ProxyEntry, proxyURL string) (*udpSocket, error) {
+	if proxyURL == "#" {
+		return nil, fmt.Errorf("connection blocked by proxy configuration")
+	}
+
+	key := proxyURL
+	bind := proxyEntry.Bind
+	if directBind, ok := splitDirectBind(proxyURL); ok {
+		bind = directBind
+		proxyURL = ""
+	}
+	if proxyURL == "" {
+		key = directBindPrefix + bind
+	}
+
+	a.mu.Lock()
+	socket, exists := a.sockets[key]
+	a.mu.Unlock()
+	if exists {
+		return socket, nil
+	}
+
+	var err error
+	if proxyURL == "" {
+		socket, err = a.openDirect(bind)
+	} else {
+		socket, err = a.openSocks5Relay(proxyEntry, proxyURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		socket.close()
+		return nil, fmt.Errorf("UDP association closed")
+	}
+	if existing, exists := a.sockets[key]; exists {
+		// Another destination opened a socket for the upstream meanwhile.
+		a.mu.Unlock()
+		socket.close()
+		return existing, nil
+	}
+	a.sockets[key] = socket
+	a.mu.Unlock()
+
+	go a.receive(socket)
+	return socket, nil
+}
+
+func (a *udpAssociation) openDirect(bind string) (*udpSocket, error) {
+	conn, err := listenUDPBound(bind)
+	if err != nil {
+		return nil, err
+	}
+	return &udpSocket{conn: conn}, nil
+}
+
+// openSocks5Relay asks an upstream SOCKS5 server for a UDP relay. The server
+// keeps the relay open for as long as the control connection stays open.
+// Closing the association aborts the request.
+func (a *udpAssociation) openSocks5Relay(proxyEntry *config.ProxyEntry, proxyURL string) (*udpSocket, error) {
+	if err := proxyEntry.GetTLSError(); err != nil {
+		return nil, err
+	}
+	hops, err := parseProxyChain(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	hopURL := hops[0]
+	if len(hops) > 1 || (hopURL.Scheme != "socks5" && hopURL.Scheme != "socks5h") {
+		return nil, errUDPNotSupported
+	}
+
+	dialer := &net.Dialer{Timeout: proxyEntry.GetConnectTimeout()}
+	if err := applyBind(dialer, proxyEntry.Bind); err != nil {
+		return nil, err
+	}
+
+	control, err := dialer.DialContext(a.ctx, "tcp", proxyHostPort(hopURL))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SOCKS5 proxy: %w", err)
+	}
+
+	var boundAddr string
+	err = runHandshake(a.ctx, control, proxyEntry.GetHandshakeTimeout(), func() error {
+		boundAddr, err = socks5Handshake(control, hopURL.User, socks5CommandUDP, "0.0.0.0:0")
+		return err
+	})
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", boundAddr)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("invalid UDP relay address %s: %w", boundAddr, err)
+	}
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	conn, err := listenUDPBound(proxyEntry.Bind)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	socket := &udpSocket{
+		conn:           conn,
+		relayAddr:      relayAddr,
+		control:        control,
+		resolveLocally: proxyEntry.ResolvesLocally(hopURL.Scheme),
+	}
+
+	go func() {
+		io.Copy(io.Discard, control)
+		socket.close()
+	}()
+
+	return socket, nil
+}
+
+// receive passes the datagrams arriving on socket back to the client.
+func (a *udpAssociation) receive(socket *udpSocket) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := socket.conn.ReadFromUDP(buf)
+		if err != nil {
+			a.forget(socket)
+			return
+		}
+
+		var packet []byte
+		if socket.relayAddr != nil {
+			if !from.IP.Equal(socket.relayAddr.IP) || from.Port != socket.relayAddr.Port || n < 4 {
+				continue
+			}
+			reader := bytes.NewReader(buf[3:n])
+			fromAddr, err := readSocks5Addr(reader)
+			if err != nil {
+				continue
+			}
+			header, err := appendSocks5Addr(bytes.Clone(buf[:3]), a.replyAddr(fromAddr))
+			if err != nil {
+				continue
+			}
+			packet = append(header, buf[n-reader.Len():n]...)
+		} else {
+			fromAddr := net.JoinHostPort(from.IP.String(), strconv.Itoa(from.Port))
+			header, err := appendSocks5Addr([]byte{0, 0, 0}, a.replyAddr(fromAddr))
+			if err != nil {
+				continue
+			}
+			packet = append(header, buf[:n]...)
+		}
+
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+
+		a.client.WriteToUDP(packet, clientAddr)
+	}
+}
+
+// resolve replaces the hostname of addr with its first address from the DNS
+// cache, giving up when the association ends.
+func (a *udpAssociation) resolve(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr
+	}
+
+	ips, err := a.handler.cache.ResolveHostContext(a.ctx, host)
+	if err != nil || len(ips) == 0 {
+		return addr
+	}
+	return net.JoinHostPort(ips[0].String(), port)
+}
+
+// forget drops a closed socket so that the next datagram to one of its
+// destinations is routed again.
+func (a *udpAssociation) forget(socket *udpSocket) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, s := range a.sockets {
+		if s == socket {
+			delete(a.sockets, key)
+		}
+	}
+	for _, addr := range a.routes.Keys() {
+		if s, _ := a.routes.Peek(addr); s == socket {
+			a.routes.Remove(addr)
+		}
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	a.cancel()
+	a.client.Close()
+	for _, socket := range a.sockets {
+		socket.close()
+	}
+}
+
+func (s *udpSocket) close() {
+	s.conn.Close()
+	if s.control != nil {
+		s.control.Close()
+	}
+}
@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpEchoServer returns the address of a UDP server that sends back what it
+// receives.
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// udpClient is a SOCKS5 client with a UDP association.
+type udpClient struct {
+	t       *testing.T
+	control net.Conn
+	conn    *net.UDPConn
+	relay   *net.UDPAddr
+}
+
+// associate requests a UDP association from the SOCKS5 server at socksAddr.
+func associate(t *testing.T, socksAddr string) *udpClient {
+	t.Helper()
+
+	control, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { control.Close() })
+
+	boundAddr, err := socks5Handshake(control, nil, socks5CommandUDP, "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ResolveUDPAddr("udp", boundAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &udpClient{t: t, control: control, conn: conn, relay: relay}
+}
+
+func (c *udpClient) send(addr string, payload string) {
+	c.t.Helper()
+
+	header, err := appendSocks5Addr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.WriteToUDP(append(header, payload...), c.relay); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive returns the source address and payload of the next datagram, or
+// fails the test when none arrives in time.
+func (c *udpClient) receive() (string, string) {
+	c.t.Helper()
+
+	buf := make([]byte, maxUDPPacketSize)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	reader := bytes.NewReader(buf[3:n])
+	addr, err := readSocks5Addr(reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return addr, string(buf[n-reader.Len() : n])
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+	handler := newTestHandler(t, `
+defaultProxy: direct
+rules: []
+`)
+	client := associate(t, startSocksServer(t, handler))
+	echo := udpEchoServer(t)
+
+	client.send(echo.String(), "ping")
+	if from, payload := client.receive(); from != echo.String() || payload != "ping" {
+		t.Errorf("got %q from %s, want ping from %s", payload, from, echo)
+	}
+}
+
+func TestSocksUDPRoutesOffTheReadLoop(t *testing.T) {
+	stuck, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := stuck.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: direct
+proxies:
+  stuck:
+    urls: ["socks5://%s"]
+    timeouts:
+      handshakeSeconds: 60
+rules:
+  - hosts: "stuck.example"
+    proxy: stuck
+`, stuck.Addr()))
+	client := associate(t, startSocksServer(t, handler))
+	echo := udpEchoServer(t)
+
+	// The upstream never answers the UDP ASSOCIATE of the first destination.
+	client.send("stuck.example:9", "lost")
+	var upstream net.Conn
+	select {
+	case upstream = <-accepted:
+		defer upstream.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream was not asked for a relay")
+	}
+
+	client.send(echo.String(), "ping")
+	if _, payload := client.receive(); payload != "ping" {
+		t.Errorf("got %q, want ping", payload)
+	}
+
+	// Ending the association aborts the request to the upstream.
+	client.control.Close()
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	for {
+		if _, err := upstream.Read(buf); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("relay request still open after the association closed")
+			}
+			break
+		}
+	}
+}
+
+func TestSocksUDPRelayRepliesFromFakeIP(t *testing.T) {
+	upstream := newTestHandler(t, `
+defaultProxy: direct
+rules: []
+`)
+	upstreamAddr := startSocksServer(t, upstream)
+	echo := udpEchoServer(t)
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+proxies:
+  upstream: "socks5://%s"
+hosts:
+  echo.example: "127.0.0.1"
+fakeIP:
+  range: "198.18.0.0/24"
+rules: []
+`, upstreamAddr))
+	client := associate(t, startSocksServer(t, handler))
+
+	fakeIP := handler.cache.FakeIP("echo.example")
+	if fakeIP == nil {
+		t.Fatal("no fake IP for echo.example")
+	}
+	fakeAddr := net.JoinHostPort(fakeIP.String(), strconv.Itoa(echo.Port))
+
+	client.send(fakeAddr, "ping")
+	if from, payload := client.receive(); from != fakeAddr || payload != "ping" {
+		t.Errorf("got %q from %s, want ping from %s", payload, from, fakeAddr)
+	}
+}
+
+// slowForwarder returns the address of a TCP forwarder to target that waits
+// for delay before forwarding each connection, and the number of forwarded
+// connections still open.
+func slowForwarder(t *testing.T, target string, delay time.Duration) (string, *atomic.Int32) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	open := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			open.Add(1)
+			go func() {
+				defer open.Add(-1)
+				defer conn.Close()
+				time.Sleep(delay)
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(conn, upstream)
+				io.Copy(upstream, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), open
+}
+
+func TestSocksUDPSharesRelaysOpenedConcurrently(t *testing.T) {
+	upstream := newTestHandler(t, `
+defaultProxy: direct
+rules: []
+`)
+	forwarder, open := slowForwarder(t, startSocksServer(t, upstream), 200*time.Millisecond)
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+proxies:
+  upstream: "socks5://%s"
+rules: []
+`, forwarder))
+	client := associate(t, startSocksServer(t, handler))
+
+	// Both destinations ask for a relay before either is open.
+	first, second := udpEchoServer(t), udpEchoServer(t)
+	client.send(first.String(), "ping")
+	client.send(second.String(), "ping")
+	for range 2 {
+		if _, payload := client.receive(); payload != "ping" {
+			t.Fatalf("got %q, want ping", payload)
+		}
+	}
+
+	client.control.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for open.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d relay connections still open after the association closed", open.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
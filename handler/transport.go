@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+const transportContextKey contextKey = "transport"
+
+// transportPool keeps one http.Transport per proxy entry and upstream, so a
+// kept-alive connection opened through one upstream is never reused for a
+// request the rules route to another entry, or that a group sends to another
+// member. The pool is replaced whenever the config changes.
+type transportPool struct {
+	base       *http.Transport
+	transports map[transportKey]*http.Transport
+	mu         sync.Mutex
+}
+
+// transportKey is a proxy entry name and the URL of the upstream selected
+// first among its members.
+type transportKey struct {
+	proxyName string
+	proxyURL  string
+}
+
+func newTransportPool(base *http.Transport) *transportPool {
+	return &transportPool{
+		base:       base,
+		transports: make(map[transportKey]*http.Transport),
+	}
+}
+
+// get returns the transport for the upstream selected for the named proxy
+// entry, creating it on first use.
+func (t *transportPool) get(proxyName string, selection upstreamSelection) *http.Transport {
+	key := transportKey{proxyName: proxyName}
+	if len(selection.urls) > 0 {
+		key.proxyURL = selection.urls[0]
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	transport, exists := t.transports[key]
+	if !exists {
+		transport = t.base.Clone()
+		t.transports[key] = transport
+	}
+	return transport
+}
+
+// closeIdle closes the idle connections of every transport. Connections
+// still serving a request return to a pool no new request uses and are
+// closed once the idle connection timeout expires.
+func (t *transportPool) closeIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, transport := range t.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// selectTransport makes goproxy send the request through the transport
+// chosen for its proxy entry instead of the shared one.
+func selectTransport(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if transport, ok := req.Context().Value(transportContextKey).(*http.Transport); ok {
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			return transport.RoundTrip(req)
+		})
+	}
+	return req, nil
+}
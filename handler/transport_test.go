@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTransportPoolKeys(t *testing.T) {
+	pool := newTransportPool(&http.Transport{})
+	first := upstreamSelection{urls: []string{"http://a:3128", "http://b:3128"}}
+	failedOver := upstreamSelection{urls: []string{"http://b:3128", "http://a:3128"}}
+
+	transport := pool.get("group", first)
+	if pool.get("group", first) != transport {
+		t.Error("same entry and upstream got another transport")
+	}
+	if pool.get("group", failedOver) == transport {
+		t.Error("another member of the group shares the transport")
+	}
+	if pool.get("other", first) == transport {
+		t.Error("another entry with the same upstream shares the transport")
+	}
+	if pool.get("direct", upstreamSelection{}) == nil {
+		t.Error("no transport for an entry without upstreams")
+	}
+}
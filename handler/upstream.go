@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goProxy/config"
+)
+
+type upstreamHealth struct {
+	failedUntil time.Time
+	rtt         time.Duration
+	checkedAt   time.Time
+}
+
+// upstreamState remembers which upstream URLs recently failed so that
+// failover groups skip them until their cooldown expires, and the latency
+// measured by health checks for "fastest" groups.
+type upstreamState struct {
+	health map[string]*upstreamHealth
+	mu     sync.RWMutex
+}
+
+// upstreamSelection is the order in which the members of a proxy entry are
+// tried, together with a short explanation for logging.
+type upstreamSelection struct {
+	entry  *config.ProxyEntry
+	urls   []string
+	reason string
+}
+
+func newUpstreamState() *upstreamState {
+	return &upstreamState{
+		health: make(map[string]*upstreamHealth),
+	}
+}
+
+// order returns the upstream URLs of the entry to try: healthy ones first,
+// followed by the ones still cooling down as a last resort. Failover groups
+// keep the configured order, fastest groups prefer the lowest measured RTT.
+func (s *upstreamState) order(entry *config.ProxyEntry) upstreamSelection {
+	if !entry.IsGroup() {
+		return upstreamSelection{entry: entry, urls: entry.URLs}
+	}
+
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	healthy := make([]string, 0, len(entry.URLs))
+	var cooling []string
+	for _, proxyURL := range entry.URLs {
+		if h, exists := s.health[proxyURL]; exists && now.Before(h.failedUntil) {
+			cooling = append(cooling, proxyURL)
+		} else {
+			healthy = append(healthy, proxyURL)
+		}
+	}
+
+	if entry.IsFastest() {
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return s.rttLocked(healthy[i]) < s.rttLocked(healthy[j])
+		})
+	}
+
+	urls := append(healthy, cooling...)
+
+	return upstreamSelection{
+		entry:  entry,
+		urls:   urls,
+		reason: s.describeLocked(entry, urls[0], cooling),
+	}
+}
+
+// rttLocked returns the measured RTT of the upstream, or the maximum duration
+// if it has not been measured yet, so unmeasured members sort last.
+func (s *upstreamState) rttLocked(proxyURL string) time.Duration {
+	if h, exists := s.health[proxyURL]; exists && h.rtt > 0 {
+		return h.rtt
+	}
+	return time.Duration(1<<63 - 1)
+}
+
+func (s *upstreamState) describeLocked(entry *config.ProxyEntry, picked string, cooling []string) string {
+	var reason string
+	if entry.IsFastest() {
+		if h, exists := s.health[picked]; exists && h.rtt > 0 {
+			reason = fmt.Sprintf("fastest %s, rtt %s checked %s ago", describeUpstream(picked), h.rtt.Round(time.Millisecond), time.Since(h.checkedAt).Round(time.Second))
+		} else {
+			reason = fmt.Sprintf("fastest %s, no latency data", describeUpstream(picked))
+		}
+	} else {
+		reason = fmt.Sprintf("failover %s", describeUpstream(picked))
+	}
+
+	if len(cooling) > 0 {
+		described := make([]string, len(cooling))
+		for i, proxyURL := range cooling {
+			described[i] = describeUpstream(proxyURL)
+		}
+		reason += fmt.Sprintf(", cooling down: %s", strings.Join(described, " "))
+	}
+
+	return reason
+}
+
+func (s *upstreamState) getLocked(proxyURL string) *upstreamHealth {
+	h, exists := s.health[proxyURL]
+	if !exists {
+		h = &upstreamHealth{}
+		s.health[proxyURL] = h
+	}
+	return h
+}
+
+func (s *upstreamState) markFailed(proxyURL string, cooldown time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.getLocked(proxyURL)
+	h.failedUntil = time.Now().Add(cooldown)
+}
+
+func (s *upstreamState) markHealthy(proxyURL string) {
+	s.mu.RLock()
+	h, exists := s.health[proxyURL]
+	failed := exists && !h.failedUntil.IsZero()
+	s.mu.RUnlock()
+
+	if !failed {
+		return
+	}
+
+	s.mu.Lock()
+	h.failedUntil = time.Time{}
+	s.mu.Unlock()
+}
+
+// prune drops the state of upstreams that are no longer group members, so
+// that their RTTs and cooldowns do not carry over when they come back.
+func (s *upstreamState) prune(members map[string]*config.ProxyEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for proxyURL := range s.health {
+		if _, exists := members[proxyURL]; !exists {
+			delete(s.health, proxyURL)
+		}
+	}
+}
+
+func (s *upstreamState) recordCheck(proxyURL string, rtt time.Duration, cooldown time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.getLocked(proxyURL)
+	h.checkedAt = time.Now()
+	if err != nil {
+		h.rtt = 0
+		h.failedUntil = h.checkedAt.Add(cooldown)
+		return
+	}
+	h.rtt = rtt
+	h.failedUntil = time.Time{}
+}
+
+// destinationError is a failure an upstream reports about the destination,
+// such as a refused connection. It does not count against the upstream, and
+// the other members of a group are not tried for it.
+type destinationError struct {
+	err error
+}
+
+func (e *destinationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *destinationError) Unwrap() error {
+	return e.err
+}
+
+func isDestinationError(err error) bool {
+	var destErr *destinationError
+	return errors.As(err, &destErr)
+}
+
+// upstreamError returns err as a failure of the upstream, for dials whose
+// destination is itself a proxy, such as the next hop of a chain.
+func upstreamError(err error) error {
+	var destErr *destinationError
+	if errors.As(err, &destErr) {
+		return destErr.err
+	}
+	return err
+}
+
+// describeUpstream returns a loggable form of an upstream URL without credentials.
+func describeUpstream(proxyURL string) string {
+	switch proxyURL {
+	case "":
+		return "direct"
+	case "#":
+		return "block"
+	}
+
+	hops := strings.Split(proxyURL, chainSeparator)
+	for i, hop := range hops {
+		hop = strings.TrimSpace(hop)
+		if parsedURL, err := url.Parse(hop); err == nil {
+			hop = parsedURL.Redacted()
+		}
+		hops[i] = hop
+	}
+	return strings.Join(hops, " "+chainSeparator+" ")
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"goProxy/config"
+)
+
+func TestUpstreamOrder(t *testing.T) {
+	state := newUpstreamState()
+	group := config.NewProxyEntry("http://a:3128", "http://b:3128", "http://c:3128")
+
+	if got := state.order(group).urls; !reflect.DeepEqual(got, group.URLs) {
+		t.Errorf("order() = %v, want the configured order", got)
+	}
+
+	state.markFailed("http://a:3128", time.Hour)
+	selection := state.order(group)
+	if want := []string{"http://b:3128", "http://c:3128", "http://a:3128"}; !reflect.DeepEqual(selection.urls, want) {
+		t.Errorf("order() = %v after a failure, want %v", selection.urls, want)
+	}
+	if !strings.Contains(selection.reason, "cooling down: http://a:3128") {
+		t.Errorf("reason %q does not mention the cooling member", selection.reason)
+	}
+
+	state.markHealthy("http://a:3128")
+	if got := state.order(group).urls; !reflect.DeepEqual(got, group.URLs) {
+		t.Errorf("order() = %v after recovery, want the configured order", got)
+	}
+
+	state.markFailed("http://b:3128", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if got := state.order(group).urls; !reflect.DeepEqual(got, group.URLs) {
+		t.Errorf("order() = %v after the cooldown, want the configured order", got)
+	}
+
+	single := config.NewProxyEntry("http://a:3128")
+	state.markFailed("http://a:3128", time.Hour)
+	if got := state.order(single).urls; !reflect.DeepEqual(got, single.URLs) {
+		t.Errorf("order() = %v for a single upstream", got)
+	}
+}
+
+func TestDescribeUpstream(t *testing.T) {
+	tests := map[string]string{
+		"":                                     "direct",
+		"#":                                    "block",
+		"http://user:pw@a:3128":                "http://user:xxxxx@a:3128",
+		"socks5://a:1080 -> http://u:p@b:3128": "socks5://a:1080 -> http://u:xxxxx@b:3128",
+	}
+	for proxyURL, want := range tests {
+		if got := describeUpstream(proxyURL); got != want {
+			t.Errorf("describeUpstream(%q) = %q, want %q", proxyURL, got, want)
+		}
+	}
+}
+
+func TestDialContextFailsOver(t *testing.T) {
+	upstream := httptest.NewServer(connectProxyServer)
+	defer upstream.Close()
+	dead := deadAddr(t)
+	target := echoServer(t)
+
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: group
+healthCheck:
+  target: %q
+  intervalSeconds: 3600
+proxies:
+  group:
+    urls: ["http://%s", %q]
+rules: []
+`, target, dead, upstream.URL))
+	entry := handler.decision.config.Proxies["group"]
+
+	ctx := context.WithValue(context.Background(), proxyContextKey, handler.upstreams.order(entry))
+	conn, err := handler.dialContext(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got := handler.upstreams.order(entry).urls; got[0] != upstream.URL {
+		t.Errorf("order() = %v, want the failed member last", got)
+	}
+}
+
+func TestDialContextKeepsMembersOnDestinationErrors(t *testing.T) {
+	dead := deadAddr(t)
+	target := echoServer(t)
+	badGateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == dead {
+			http.Error(w, "destination unreachable", http.StatusBadGateway)
+			return
+		}
+		connectProxyServer(w, r)
+	}))
+	defer badGateway.Close()
+	socksUpstream := startSocksServer(t, newTestHandler(t, "defaultProxy: direct\nrules: []\n"))
+
+	tests := []struct {
+		name  string
+		first string
+	}{
+		{"HTTP proxy answering 502", badGateway.URL},
+		{"SOCKS5 proxy refused by the destination", "socks5://" + socksUpstream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := make(chan string, 10)
+			spare := recordingProxy(t, targets)
+			handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: group
+healthCheck:
+  target: %q
+  intervalSeconds: 3600
+proxies:
+  group:
+    urls: [%q, %q]
+rules: []
+`, target, tt.first, spare.URL))
+			entry := handler.decision.config.Proxies["group"]
+
+			ctx := context.WithValue(context.Background(), proxyContextKey, handler.upstreams.order(entry))
+			if _, err := handler.dialContext(ctx, "tcp", dead); !isDestinationError(err) {
+				t.Fatalf("dialContext() = %v, want the destination error", err)
+			}
+			for len(targets) > 0 {
+				if asked := <-targets; asked == dead {
+					t.Error("the next member was tried for the same destination")
+				}
+			}
+			if got := handler.upstreams.order(entry).urls; got[0] != tt.first {
+				t.Errorf("order() = %v, want the member kept first", got)
+			}
+		})
+	}
+}
+
+func TestSocksServerPassesDestinationReplies(t *testing.T) {
+	socksUpstream := startSocksServer(t, newTestHandler(t, "defaultProxy: direct\nrules: []\n"))
+	handler := newTestHandler(t, fmt.Sprintf(`
+defaultProxy: upstream
+proxies:
+  upstream: "socks5://%s"
+rules: []
+`, socksUpstream))
+
+	_, err := socks5Client(startSocksServer(t, handler)).DialContext(context.Background(), "tcp", deadAddr(t))
+	var replyErr *socks5ReplyError
+	if !errors.As(err, &replyErr) || replyErr.code != socks5ReplyConnectionRefused {
+		t.Errorf("got %v, want the connection refused reply of the upstream", err)
+	}
+}
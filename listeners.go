@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"goProxy/config"
+	"goProxy/handler"
+	"goProxy/logger"
+)
+
+// runningListener is a started listener together with the settings it was
+// started with.
+type runningListener struct {
+	config       config.ListenerConfig
+	certificates *certificateStore
+	close        func() error
+}
+
+// certificateStore holds the certificate of a TLS listener, so that a reload
+// can replace it without dropping connections.
+type certificateStore struct {
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+func (c *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate.Load(), nil
+}
+
+// listenerReconciler keeps the running listeners in line with the config,
+// restarting only the ones whose socket settings changed.
+type listenerReconciler struct {
+	handler *handler.ProxyHandler
+	running map[string]*runningListener
+	mu      sync.Mutex
+}
+
+func newListenerReconciler(proxyHandler *handler.ProxyHandler) *listenerReconciler {
+	return &listenerReconciler{
+		handler: proxyHandler,
+		running: make(map[string]*runningListener),
+	}
+}
+
+// Reconcile starts, stops and restarts listeners to match listeners. It
+// returns the errors of the listeners that could not be started, which are
+// tried again on the next call.
+func (r *listenerReconciler) Reconcile(listeners []config.ListenerConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wanted := make(map[string]config.ListenerConfig)
+	for _, listener := range listeners {
+		wanted[listener.Name] = listener
+	}
+
+	for name, running := range r.running {
+		listener, exists := wanted[name]
+		if exists && !needsRestart(running.config, listener) {
+			running.config = listener
+			running.updateCertificate()
+			logger.Debug("Listener '%s' unchanged (%s), no restart needed", name, listener.Addr)
+			continue
+		}
+
+		logger.Info("Stopping listener '%s' on %s", name, running.config.Addr)
+		if err := running.close(); err != nil {
+			logger.Error("Error closing listener '%s': %v", name, err)
+		}
+		delete(r.running, name)
+	}
+
+	var errs []error
+	for _, listener := range listeners {
+		if _, exists := r.running[listener.Name]; exists {
+			continue
+		}
+		running, err := r.start(listener)
+		if err != nil {
+			logger.Error("Listener '%s' error: %v", listener.Name, err)
+			errs = append(errs, fmt.Errorf("listener '%s': %w", listener.Name, err))
+			continue
+		}
+		r.running[listener.Name] = running
+	}
+	return errors.Join(errs...)
+}
+
+func (r *listenerReconciler) CloseAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, running := range r.running {
+		if err := running.close(); err != nil {
+			logger.Error("Error closing listener '%s': %v", name, err)
+		}
+		delete(r.running, name)
+	}
+}
+
+// start opens the listener and serves it in the background.
+func (r *listenerReconciler) start(listener config.ListenerConfig) (*runningListener, error) {
+	protocol := listener.GetProtocol()
+	if listener.TLS != nil {
+		protocol += " over TLS"
+	}
+	logger.Info("Starting %s listener '%s' on %s", protocol, listener.Name, listener.Addr)
+
+	if listener.GetProtocol() == config.ProtocolDNS {
+		return r.startDNS(listener)
+	}
+
+	var certificates *certificateStore
+	if listener.TLS != nil {
+		certificate, err := listener.TLS.GetCertificate()
+		if err != nil {
+			return nil, err
+		}
+		certificates = &certificateStore{}
+		certificates.certificate.Store(certificate)
+	}
+
+	netListener, err := listen(listener)
+	if err != nil {
+		return nil, err
+	}
+
+	if certificates != nil {
+		netListener = tls.NewListener(netListener, &tls.Config{
+			GetCertificate: certificates.getCertificate,
+			NextProtos:     []string{"http/1.1"},
+		})
+	}
+
+	if listener.GetProtocol() == config.ProtocolSocks5 {
+		server := handler.NewSocksServer(listener.Name, listener.Addr, r.handler)
+		go func() {
+			if err := server.Serve(netListener); err != nil && err != handler.ErrSocksServerClosed {
+				logger.Error("Listener '%s' error: %v", listener.Name, err)
+			}
+		}()
+		return &runningListener{config: listener, certificates: certificates, close: server.Close}, nil
+	}
+
+	server := &http.Server{
+		Addr:    listener.Addr,
+		Handler: r.handler.ListenerHandler(listener.Name),
+	}
+	go func() {
+		if err := server.Serve(netListener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Listener '%s' error: %v", listener.Name, err)
+		}
+	}()
+	return &runningListener{config: listener, certificates: certificates, close: server.Close}, nil
+}
+
+// startDNS opens the UDP and TCP sockets of a DNS listener on its address.
+func (r *listenerReconciler) startDNS(listener config.ListenerConfig) (*runningListener, error) {
+	network, addr := listener.GetNetwork()
+	if network != "tcp" {
+		return nil, fmt.Errorf("DNS needs a host:port address")
+	}
+
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	netListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+
+	server := handler.NewDNSServer(listener.Name, listener.Addr, r.handler)
+	go func() {
+		if err := server.ServeUDP(packetConn); err != nil && err != handler.ErrDNSServerClosed {
+			logger.Error("Listener '%s' error: %v", listener.Name, err)
+		}
+	}()
+	go func() {
+		if err := server.ServeTCP(netListener); err != nil && err != handler.ErrDNSServerClosed {
+			logger.Error("Listener '%s' error: %v", listener.Name, err)
+		}
+	}()
+	return &runningListener{config: listener, close: server.Close}, nil
+}
+
+// updateCertificate switches a TLS listener to the certificate loaded with
+// the current config, keeping the previous one if that failed to load.
+func (l *runningListener) updateCertificate() {
+	if l.certificates == nil {
+		return
+	}
+
+	certificate, err := l.config.TLS.GetCertificate()
+	if err != nil {
+		logger.Warn("Listener '%s' keeps its previous certificate: %v", l.config.Name, err)
+		return
+	}
+	l.certificates.certificate.Store(certificate)
+}
+
+// listen opens the socket of a listener. A unix socket left behind by an
+// unclean shutdown, which refuses connections, is removed first; one still
+// served by another process is left alone. The socket file is removed again
+// when the listener is closed.
+func listen(listener config.ListenerConfig) (net.Listener, error) {
+	network, addr := listener.GetNetwork()
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout(network, addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use by another process", addr)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("failed to check socket %s: %v", addr, err)
+		}
+		if err := os.Remove(addr); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", addr, err)
+		}
+	}
+
+	netListener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode := listener.GetSocketMode(); mode != 0 {
+		if err := os.Chmod(addr, mode); err != nil {
+			netListener.Close()
+			return nil, fmt.Errorf("failed to set mode of %s: %v", addr, err)
+		}
+	}
+
+	if listener.SocketOwner != "" {
+		if err := chownSocket(addr, listener.SocketOwner); err != nil {
+			netListener.Close()
+			return nil, err
+		}
+	}
+
+	return netListener, nil
+}
+
+// chownSocket changes the owner of the socket file to "user" or "user:group",
+// given as names or numeric IDs.
+func chownSocket(path, owner string) error {
+	userName, groupName, _ := strings.Cut(owner, ":")
+
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return fmt.Errorf("unknown socket owner '%s': %v", userName, err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return fmt.Errorf("unknown socket group '%s': %v", groupName, err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to change owner of %s: %v", path, err)
+	}
+	return nil
+}
+
+// needsRestart reports whether a listener has to be reopened. Routing
+// settings are looked up per connection and apply without a restart.
+func needsRestart(old, new config.ListenerConfig) bool {
+	return old.Addr != new.Addr || old.GetProtocol() != new.GetProtocol() ||
+		old.SocketMode != new.SocketMode || old.SocketOwner != new.SocketOwner ||
+		(old.TLS == nil) != (new.TLS == nil)
+}
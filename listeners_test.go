@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"goProxy/cache"
+	"goProxy/config"
+	"goProxy/handler"
+)
+
+// loadTestConfig writes YAML to config.yaml in dir, which is also the
+// profile directory, and loads it.
+func loadTestConfig(t *testing.T, cacheManager *cache.CacheManager, dir, yaml string) *config.ProxyConfig {
+	t.Helper()
+
+	t.Setenv("PROFILE_PLACE", dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml+"\nlogLevel: error\nlogFile: \"\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.LoadConfig(path, cacheManager, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func newTestReconciler(t *testing.T) *listenerReconciler {
+	t.Helper()
+
+	cacheManager := cache.NewCacheManager()
+	cfg := loadTestConfig(t, cacheManager, t.TempDir(), "defaultProxy: direct\nrules: []\n")
+	proxyHandler := handler.NewProxyHandler(cfg, cacheManager)
+	t.Cleanup(proxyHandler.Close)
+
+	reconciler := newListenerReconciler(proxyHandler)
+	t.Cleanup(reconciler.CloseAll)
+	return reconciler
+}
+
+func TestReconcileReportsListenersThatCannotStart(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	reconciler := newTestReconciler(t)
+	listeners := []config.ListenerConfig{
+		{Name: "free", Addr: "127.0.0.1:0"},
+		{Name: "taken", Addr: taken.Addr().String()},
+	}
+
+	if err := reconciler.Reconcile(listeners); err == nil {
+		t.Fatal("Reconcile() succeeded with an address in use")
+	}
+	if _, running := reconciler.running["free"]; !running {
+		t.Error("listener on a free address was not started")
+	}
+
+	taken.Close()
+	if err := reconciler.Reconcile(listeners); err != nil {
+		t.Fatalf("Reconcile() = %v once the address is free", err)
+	}
+	if _, running := reconciler.running["taken"]; !running {
+		t.Error("listener was not started once its address became free")
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket file modes are not supported on Windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "goproxy.sock")
+	// A socket file left behind by an unclean shutdown.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener := config.ListenerConfig{
+		Name:        "unix",
+		Addr:        "unix:" + path,
+		SocketMode:  "0600",
+		SocketOwner: strconv.Itoa(os.Getuid()),
+	}
+	netListener, err := listen(listener)
+	if err != nil {
+		t.Fatalf("listen() = %v with a stale socket file", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	netListener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket file left behind after closing the listener")
+	}
+
+	listener.SocketOwner = "no-such-user-goproxy"
+	if _, err := listen(listener); err == nil {
+		t.Error("listen() succeeded with an unknown owner")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket file left behind after a failed listen")
+	}
+}
+
+func TestListenUnixSocketInUse(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket files are not checked on Windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "goproxy.sock")
+	// A socket still served by another process.
+	active, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	go func() {
+		for {
+			conn, err := active.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	if netListener, err := listen(config.ListenerConfig{Name: "unix", Addr: "unix:" + path}); err == nil {
+		netListener.Close()
+		t.Fatal("listen() took over a socket in use")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("socket in use was removed: %v", err)
+	}
+	conn.Close()
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 to
+// server.pem and server.key in dir and returns it.
+func writeCertificate(t *testing.T, dir string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, "server.pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "server.key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// connectOverTLS opens a tunnel through the HTTPS proxy at addr and returns
+// the certificate the proxy presented.
+func connectOverTLS(t *testing.T, addr, target string) *x509.Certificate {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", response.Status)
+	}
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	first := writeCertificate(t, dir)
+	targetListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetListener.Close()
+	target := targetListener.Addr().String()
+	go func() {
+		for {
+			conn, err := targetListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	yaml := fmt.Sprintf(`
+defaultProxy: direct
+listeners:
+  - name: https
+    addr: %q
+    tls:
+      certFile: server.pem
+      keyFile: server.key
+rules: []
+`, freeAddr(t))
+	cacheManager := cache.NewCacheManager()
+	cfg := loadTestConfig(t, cacheManager, dir, yaml)
+	proxyHandler := handler.NewProxyHandler(cfg, cacheManager)
+	defer proxyHandler.Close()
+	reconciler := newListenerReconciler(proxyHandler)
+	defer reconciler.CloseAll()
+
+	if err := reconciler.Reconcile(cfg.GetListeners()); err != nil {
+		t.Fatal(err)
+	}
+	addr := cfg.GetListeners()[0].Addr
+	if got := connectOverTLS(t, addr, target); !got.Equal(first) {
+		t.Error("listener presented another certificate")
+	}
+
+	// A reload picks up a renewed certificate without a restart.
+	running := reconciler.running["https"]
+	second := writeCertificate(t, dir)
+	cfg = loadTestConfig(t, cacheManager, dir, yaml)
+	if err := reconciler.Reconcile(cfg.GetListeners()); err != nil {
+		t.Fatal(err)
+	}
+	if reconciler.running["https"] != running {
+		t.Error("listener was restarted for a new certificate")
+	}
+	if got := connectOverTLS(t, addr, target); !got.Equal(second) {
+		t.Error("listener still presents the old certificate after a reload")
+	}
+
+	// A broken certificate keeps the previous one.
+	os.WriteFile(filepath.Join(dir, "server.key"), []byte("broken"), 0600)
+	cfg = loadTestConfig(t, cacheManager, dir, yaml)
+	reconciler.Reconcile(cfg.GetListeners())
+	if got := connectOverTLS(t, addr, target); !got.Equal(second) {
+		t.Error("listener dropped its certificate for a broken one")
+	}
+}
@@ -122,27 +122,17 @@ func InitDefaultLogger() {
 	globalLogger = NewLogger(&DefaultConfigProvider{})
 }
 
+// ReconfigureGlobalLogger replaces the global logger with one using config.
+// The old logger is not modified so that callers still holding it keep
+// working; its file is closed once it has been replaced.
 func ReconfigureGlobalLogger(config ConfigProvider) {
 	loggerMutex.Lock()
 	defer loggerMutex.Unlock()
 
-	if globalLogger != nil {
-		// Close the old file logger
-		globalLogger.Close()
-
-		// Create a new logger with the updated configuration
-		fileLogger, err := NewFileLogger(config)
-		if err != nil {
-			log.Printf("Failed to reconfigure file logger: %v, falling back to stdout", err)
-			fileLogger = nil
-		}
-
-		// Update the logger with new configuration
-		globalLogger.config = config
-		globalLogger.fileLogger = fileLogger
-	} else {
-		// If no logger exists, initialize it
-		globalLogger = NewLogger(config)
+	previous := globalLogger
+	globalLogger = NewLogger(config)
+	if previous != nil {
+		previous.Close()
 	}
 }
 
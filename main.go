@@ -3,11 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sync"
 	"syscall"
 	"time"
 
@@ -42,56 +40,13 @@ func main() {
 	}
 
 	proxyHandler := handler.NewProxyHandler(currentConfig, cacheManager)
-	currentListenAddr := currentConfig.ListenAddr
-
-	server := &http.Server{
-		Addr:    currentListenAddr,
-		Handler: proxyHandler,
-	}
-
-	serverMutex := &sync.Mutex{}
-	currentServer := server
-
-	logger.Info("Starting proxy server on %s", currentListenAddr)
+	listeners := newListenerReconciler(proxyHandler)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
 
 	trayManager := tray.NewTrayManager()
 
-	restartServerIfAddressChanged := func(newConfig *config.ProxyConfig) {
-		serverMutex.Lock()
-		defer serverMutex.Unlock()
-
-		newListenAddr := newConfig.ListenAddr
-
-		if newListenAddr != currentListenAddr {
-			logger.Info("Listen address changed from '%s' to '%s', restarting server...", currentListenAddr, newListenAddr)
-
-			if err := currentServer.Close(); err != nil {
-				logger.Error("Error closing old server: %v", err)
-			}
-
-			newServer := &http.Server{
-				Addr:    newListenAddr,
-				Handler: proxyHandler,
-			}
-
-			go func() {
-				logger.Info("Starting new server on %s", newListenAddr)
-				if err := newServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					logger.Error("New server error: %v", err)
-					panic(err)
-				}
-			}()
-
-			currentServer = newServer
-			currentListenAddr = newListenAddr
-		} else {
-			logger.Debug("Listen address unchanged (%s), no server restart needed", currentListenAddr)
-		}
-	}
-
 	reloadTickerChan := make(chan time.Time)
 
 	var reloadTicker *time.Ticker
@@ -126,7 +81,9 @@ func main() {
 
 		proxyHandler.UpdateConfig(currentConfig, cacheManager)
 
-		restartServerIfAddressChanged(currentConfig)
+		// Listeners that fail to start are logged and tried again on the
+		// next reload.
+		listeners.Reconcile(currentConfig.GetListeners())
 	}
 
 	go func() {
@@ -142,11 +99,7 @@ func main() {
 					return
 				}
 			case <-trayManager.GetQuitChan():
-				serverMutex.Lock()
-				if err := currentServer.Close(); err != nil {
-					logger.Error("Error closing server: %v", err)
-				}
-				serverMutex.Unlock()
+				listeners.CloseAll()
 				return
 			case <-trayManager.GetReloadChan():
 				reloadConfiguration("Manual reload from tray")
@@ -158,12 +111,10 @@ func main() {
 		}
 	}()
 
-	go func() {
-		if err := currentServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error("Server error: %v", err)
-			panic(err)
-		}
-	}()
+	if err := listeners.Reconcile(currentConfig.GetListeners()); err != nil {
+		logger.Error("Error starting listeners: %v", err)
+		panic(err)
+	}
 
 	startTicker(currentConfig.AutoReloadHours)
 	defer func() {
@@ -175,11 +126,8 @@ func main() {
 	trayManager.Start()
 
 	logger.Info("Shutting down proxy server...")
-	serverMutex.Lock()
-	if err := currentServer.Close(); err != nil {
-		logger.Error("Error closing server: %v", err)
-	}
-	serverMutex.Unlock()
+	proxyHandler.Close()
+	listeners.CloseAll()
 	logger.Info("Proxy server stopped")
 }
 
@@ -0,0 +1,298 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver sends DNS queries to configured upstream servers, tried in order,
+// with other servers for the names matching an override pattern.
+type Resolver struct {
+	servers   []server
+	overrides []override
+}
+
+// override sends the queries for names matching pattern to its servers.
+// "*.corp" matches corp and every name below it, other patterns match
+// exactly.
+type override struct {
+	pattern string
+	servers []server
+}
+
+// New returns a resolver for the given servers and overrides, which map a
+// host pattern to the server resolving matching names. dial opens the
+// connections of DNS-over-TLS and DNS-over-HTTPS servers, directly when nil.
+func New(servers []string, overrides map[string]string, dial DialFunc) (*Resolver, error) {
+	r := &Resolver{}
+	for _, address := range servers {
+		s, err := parseServer(address, dial)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, s)
+	}
+
+	for pattern, address := range overrides {
+		s, err := parseServer(address, dial)
+		if err != nil {
+			return nil, err
+		}
+		r.overrides = append(r.overrides, override{
+			pattern: strings.ToLower(strings.TrimSuffix(pattern, ".")),
+			servers: []server{s},
+		})
+	}
+
+	return r, nil
+}
+
+// serversFor returns the servers for name: those of the most specific
+// matching override, or the default ones.
+func (r *Resolver) serversFor(name string) []server {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	var best *override
+	for i := range r.overrides {
+		o := &r.overrides[i]
+		if matchesPattern(o.pattern, name) && (best == nil || len(o.pattern) > len(best.pattern)) {
+			best = o
+		}
+	}
+	if best != nil {
+		return best.servers
+	}
+	return r.servers
+}
+
+func matchesPattern(pattern, name string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return name == suffix || strings.HasSuffix(name, "."+suffix)
+	}
+	return name == pattern
+}
+
+// Exchange sends a raw query for its first question and returns the raw
+// response. network is the transport the client used, "udp" or "tcp".
+func (r *Resolver) Exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := r.serversFor(question.Name.String())
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS server configured")
+	}
+
+	var lastErr error
+	for _, s := range servers {
+		response, err := s.exchange(ctx, network, query)
+		if err == nil {
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = fmt.Errorf("%s: %w", s, err)
+	}
+	return nil, lastErr
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host and how long they may
+// be cached: the lowest TTL of the answers, or of the SOA record for names
+// that do not exist. Names without a server, when neither servers nor a
+// matching override are configured, are resolved by the system resolver,
+// which reports no TTL.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if len(r.serversFor(host)) == 0 {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		return ips, 0, err
+	}
+
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]answer, len(types))
+	errs := make([]error, len(types))
+
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = r.lookup(ctx, host, name, qtype)
+		}()
+	}
+	wg.Wait()
+
+	// Empty answers only have the TTL of their SOA record, if any, which
+	// does not limit how long the addresses of the other family are valid.
+	var ips []net.IP
+	var ttl, negativeTTL time.Duration
+	for i, result := range results {
+		if errs[i] != nil {
+			continue
+		}
+		if len(result.ips) == 0 {
+			if result.ttl > 0 && (negativeTTL == 0 || result.ttl < negativeTTL) {
+				negativeTTL = result.ttl
+			}
+			continue
+		}
+		ips = append(ips, result.ips...)
+		if ttl == 0 || result.ttl < ttl {
+			ttl = result.ttl
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, results[i].ttl, err
+		}
+	}
+	return nil, negativeTTL, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// answer holds the addresses of one response and the TTL they may be
+// cached for.
+type answer struct {
+	ips []net.IP
+	ttl time.Duration
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string, name dnsmessage.Name, qtype dnsmessage.Type) (answer, error) {
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newID(), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return answer{}, err
+	}
+
+	response, err := r.Exchange(ctx, "udp", query)
+	if err == nil && isTruncated(response) {
+		response, err = r.Exchange(ctx, "tcp", query)
+	}
+	if err != nil {
+		// No answer was received, which is not a DNS error to be cached.
+		return answer{}, fmt.Errorf("error querying DNS for %s: %w", host, err)
+	}
+
+	return parseAnswer(host, response, qtype)
+}
+
+func newID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func isTruncated(response []byte) bool {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	return err == nil && header.Truncated
+}
+
+// parseAnswer returns the addresses of the given type in a response, with
+// the lowest TTL of the answer records. A response without addresses has the
+// TTL of its SOA record, if any, for negative caching.
+func parseAnswer(host string, response []byte, qtype dnsmessage.Type) (answer, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return answer{}, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+		return answer{}, &net.DNSError{Err: "server misbehaving: " + header.RCode.String(), Name: host, IsTemporary: true}
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return answer{}, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	var result answer
+	var minTTL uint32
+	for {
+		resourceHeader, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return answer{}, &net.DNSError{Err: err.Error(), Name: host}
+		}
+		if minTTL == 0 || resourceHeader.TTL < minTTL {
+			minTTL = resourceHeader.TTL
+		}
+
+		switch {
+		case resourceHeader.Type == qtype && qtype == dnsmessage.TypeA:
+			resource, err := parser.AResource()
+			if err != nil {
+				return answer{}, &net.DNSError{Err: err.Error(), Name: host}
+			}
+			result.ips = append(result.ips, net.IP(resource.A[:]))
+		case resourceHeader.Type == qtype && qtype == dnsmessage.TypeAAAA:
+			resource, err := parser.AAAAResource()
+			if err != nil {
+				return answer{}, &net.DNSError{Err: err.Error(), Name: host}
+			}
+			result.ips = append(result.ips, net.IP(resource.AAAA[:]))
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return answer{}, &net.DNSError{Err: err.Error(), Name: host}
+			}
+		}
+	}
+
+	if len(result.ips) == 0 {
+		minTTL = soaTTL(&parser)
+	}
+	result.ttl = time.Duration(minTTL) * time.Second
+
+	if header.RCode == dnsmessage.RCodeNameError {
+		return result, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return result, nil
+}
+
+// soaTTL returns the negative caching TTL of RFC 2308 from the authority
+// section: the lower of the SOA record's TTL and its minimum field.
+func soaTTL(parser *dnsmessage.Parser) uint32 {
+	for {
+		resourceHeader, err := parser.AuthorityHeader()
+		if err != nil {
+			return 0
+		}
+		if resourceHeader.Type != dnsmessage.TypeSOA {
+			if err := parser.SkipAuthority(); err != nil {
+				return 0
+			}
+			continue
+		}
+		soa, err := parser.SOAResource()
+		if err != nil {
+			return 0
+		}
+		return min(resourceHeader.TTL, soa.MinTTL)
+	}
+}
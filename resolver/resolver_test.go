@@ -0,0 +1,225 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers queries on a TCP listener with respond and returns the
+// server address for New.
+func serveDNS(t *testing.T, respond func(question dnsmessage.Question) dnsmessage.Message) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := ReadMessage(conn)
+					if err != nil {
+						return
+					}
+					var request dnsmessage.Message
+					if err := request.Unpack(query); err != nil {
+						return
+					}
+					response := respond(request.Questions[0])
+					response.Header.ID = request.Header.ID
+					response.Header.Response = true
+					response.Questions = request.Questions
+					packed, err := response.Pack()
+					if err != nil {
+						return
+					}
+					if err := WriteMessage(conn, packed); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestLookupIPReturnsLowestTTL(t *testing.T) {
+	address := serveDNS(t, func(question dnsmessage.Question) dnsmessage.Message {
+		header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET}
+		var message dnsmessage.Message
+		switch question.Type {
+		case dnsmessage.TypeA:
+			header.TTL = 300
+			message.Answers = append(message.Answers,
+				dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+			header.TTL = 120
+			message.Answers = append(message.Answers,
+				dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}})
+		case dnsmessage.TypeAAAA:
+			header.TTL = 600
+			message.Answers = append(message.Answers,
+				dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}})
+		}
+		return message
+	})
+
+	r, err := New([]string{address}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, ttl, err := r.LookupIP(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 3 {
+		t.Errorf("got %v, want 3 addresses", ips)
+	}
+	if ttl != 120*time.Second {
+		t.Errorf("ttl = %v, want 2m0s", ttl)
+	}
+}
+
+func TestLookupIPIgnoresTTLOfEmptyAnswers(t *testing.T) {
+	address := serveDNS(t, func(question dnsmessage.Question) dnsmessage.Message {
+		var message dnsmessage.Message
+		if question.Type == dnsmessage.TypeA {
+			header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 30}
+			message.Answers = append(message.Answers,
+				dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+		}
+		return message
+	})
+
+	r, err := New([]string{address}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, ttl, err := r.LookupIP(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 {
+		t.Errorf("got %v, want the IPv4 address", ips)
+	}
+	if ttl != 30*time.Second {
+		t.Errorf("ttl = %v, want the 30s of the A record", ttl)
+	}
+}
+
+func TestLookupIPNameError(t *testing.T) {
+	address := serveDNS(t, func(question dnsmessage.Question) dnsmessage.Message {
+		soaName := dnsmessage.MustNewName("example.com.")
+		return dnsmessage.Message{
+			Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: soaName, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 900},
+				Body:   &dnsmessage.SOAResource{NS: soaName, MBox: soaName, MinTTL: 60},
+			}},
+		}
+	})
+
+	r, err := New([]string{address}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ttl, err := r.LookupIP(context.Background(), "missing.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("err = %v, want a not found DNSError", err)
+	}
+	if ttl != time.Minute {
+		t.Errorf("ttl = %v, want the SOA minimum of 1m0s", ttl)
+	}
+}
+
+func TestLookupIPServerFailure(t *testing.T) {
+	address := serveDNS(t, func(question dnsmessage.Question) dnsmessage.Message {
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+	})
+
+	r, err := New([]string{address}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = r.LookupIP(context.Background(), "example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+		t.Fatalf("err = %v, want a DNSError for the failed server", err)
+	}
+}
+
+func TestLookupIPTransportFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	r, err := New([]string{"tcp://" + address}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = r.LookupIP(context.Background(), "example.com")
+	if err == nil {
+		t.Fatal("LookupIP() succeeded without a server")
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		t.Errorf("err = %v, a query without answer must not be a DNSError", err)
+	}
+}
+
+func TestSystemServer(t *testing.T) {
+	r, err := New([]string{SystemServer}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, _, err := r.LookupIP(context.Background(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, ip := range ips {
+		found = found || ip.IsLoopback()
+	}
+	if !found {
+		t.Errorf("localhost resolved to %v", ips)
+	}
+
+	query, _ := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 7},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("localhost."), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	response, err := r.Exchange(context.Background(), "udp", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != 7 || message.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("SRV query got ID %d, %v, want 7, not implemented", message.ID, message.RCode)
+	}
+}
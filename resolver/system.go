@@ -0,0 +1,162 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SystemServer is the server address that answers queries with the
+// resolver of the operating system.
+const SystemServer = "system"
+
+// systemTTL is the TTL of the answers of the system resolver, which reports
+// none.
+const systemTTL = 60
+
+// maxTXTLength is the longest character string of a TXT record.
+const maxTXTLength = 255
+
+// systemServer answers queries with net.DefaultResolver, for platforms
+// without /etc/resolv.conf. Only A, AAAA, CNAME, MX and TXT queries are
+// supported.
+type systemServer struct{}
+
+func (s *systemServer) String() string {
+	return SystemServer
+}
+
+func (s *systemServer) exchange(ctx context.Context, _ string, query []byte) ([]byte, error) {
+	var request dnsmessage.Message
+	if err := request.Unpack(query); err != nil {
+		return nil, err
+	}
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 request.ID,
+			Response:           true,
+			OpCode:             request.OpCode,
+			RecursionDesired:   request.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: request.Questions,
+	}
+	if len(request.Questions) != 1 {
+		response.RCode = dnsmessage.RCodeFormatError
+		return response.Pack()
+	}
+
+	question := request.Questions[0]
+	answers, err := lookupSystem(ctx, question)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		response.RCode = dnsmessage.RCodeNameError
+	case errors.Is(err, errNotImplemented):
+		response.RCode = dnsmessage.RCodeNotImplemented
+	case err != nil:
+		return nil, err
+	}
+
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: systemTTL}
+	for _, body := range answers {
+		response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: body})
+	}
+	return response.Pack()
+}
+
+var errNotImplemented = errors.New("query type not supported by the system resolver")
+
+// lookupSystem returns the records answering question.
+func lookupSystem(ctx context.Context, question dnsmessage.Question) ([]dnsmessage.ResourceBody, error) {
+	if question.Class != dnsmessage.ClassINET {
+		return nil, errNotImplemented
+	}
+	host := strings.TrimSuffix(question.Name.String(), ".")
+	resolver := net.DefaultResolver
+
+	var answers []dnsmessage.ResourceBody
+	switch question.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		network, other := "ip4", "ip6"
+		if question.Type == dnsmessage.TypeAAAA {
+			network, other = "ip6", "ip4"
+		}
+		ips, err := resolver.LookupNetIP(ctx, network, host)
+		if err != nil && !isNoAddress(err) {
+			// The system resolver reports a name without addresses of the
+			// asked family as not found, but the name exists when it has
+			// addresses of the other one.
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				return nil, err
+			}
+			if otherIPs, otherErr := resolver.LookupNetIP(ctx, other, host); otherErr != nil || len(otherIPs) == 0 {
+				return nil, err
+			}
+		}
+		for _, ip := range ips {
+			if question.Type == dnsmessage.TypeA {
+				answers = append(answers, &dnsmessage.AResource{A: ip.Unmap().As4()})
+			} else {
+				answers = append(answers, &dnsmessage.AAAAResource{AAAA: ip.As16()})
+			}
+		}
+	case dnsmessage.TypeCNAME:
+		cname, err := resolver.LookupCNAME(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		name, err := dnsmessage.NewName(cname)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(cname, question.Name.String()) {
+			answers = append(answers, &dnsmessage.CNAMEResource{CNAME: name})
+		}
+	case dnsmessage.TypeMX:
+		records, err := resolver.LookupMX(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			name, err := dnsmessage.NewName(record.Host)
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, &dnsmessage.MXResource{Pref: record.Pref, MX: name})
+		}
+	case dnsmessage.TypeTXT:
+		records, err := resolver.LookupTXT(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			answers = append(answers, &dnsmessage.TXTResource{TXT: splitTXT(record)})
+		}
+	default:
+		return nil, errNotImplemented
+	}
+	return answers, nil
+}
+
+// isNoAddress reports whether err means that the name has addresses, but
+// none of the asked family, which is an empty answer rather than an error.
+func isNoAddress(err error) bool {
+	var addrErr *net.AddrError
+	return errors.As(err, &addrErr)
+}
+
+// splitTXT splits a TXT record, which the system resolver joins, into
+// character strings of the maximum length.
+func splitTXT(record string) []string {
+	var parts []string
+	for len(record) > maxTXTLength {
+		parts = append(parts, record[:maxTXTLength])
+		record = record[maxTXTLength:]
+	}
+	return append(parts, record)
+}
@@ -0,0 +1,276 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	exchangeTimeout = 5 * time.Second
+	maxMessageSize  = 65535
+)
+
+// DialFunc opens the connections of DNS-over-TLS and DNS-over-HTTPS
+// servers. Addresses are always IP:port, server hostnames are resolved by
+// the system resolver first.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// server sends queries to one upstream DNS server.
+type server interface {
+	// exchange sends a query and returns the response. network is "udp" or
+	// "tcp", the transport the query would preferably use.
+	exchange(ctx context.Context, network string, query []byte) ([]byte, error)
+	String() string
+}
+
+// parseServer parses a server address: "1.1.1.1" or "udp://1.1.1.1:53" for
+// plain DNS over UDP, "tcp://" for TCP, "tls://" for DNS-over-TLS, an
+// https:// URL for DNS-over-HTTPS and "system" for the system resolver.
+func parseServer(address string, dial DialFunc) (server, error) {
+	if address == SystemServer {
+		return &systemServer{}, nil
+	}
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	serverURL, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server '%s': %v", address, err)
+	}
+	if serverURL.Host == "" {
+		return nil, fmt.Errorf("invalid DNS server '%s': missing host", address)
+	}
+
+	switch serverURL.Scheme {
+	case "udp", "tcp":
+		return &plainServer{addr: withPort(serverURL.Host, "53"), stream: serverURL.Scheme == "tcp"}, nil
+	case "tls":
+		return &tlsServer{
+			addr:       withPort(serverURL.Host, "853"),
+			serverName: serverURL.Hostname(),
+			dial:       dial,
+		}, nil
+	case "https":
+		return newHTTPSServer(serverURL, dial), nil
+	default:
+		return nil, fmt.Errorf("invalid DNS server '%s': unsupported scheme %s", address, serverURL.Scheme)
+	}
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// plainServer speaks unencrypted DNS. UDP queries are sent over TCP when
+// the transport asks for it or when stream is set.
+type plainServer struct {
+	addr   string
+	stream bool
+}
+
+func (s *plainServer) String() string {
+	if s.stream {
+		return "tcp://" + s.addr
+	}
+	return s.addr
+}
+
+func (s *plainServer) exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+	if s.stream {
+		network = "tcp"
+	}
+
+	dialer := &net.Dialer{Timeout: exchangeTimeout}
+	conn, err := dialer.DialContext(ctx, network, s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if network == "tcp" {
+		return exchangeStream(conn, query)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not answer this query.
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// tlsServer speaks DNS-over-TLS (RFC 7858).
+type tlsServer struct {
+	addr       string
+	serverName string
+	dial       DialFunc
+}
+
+func (s *tlsServer) String() string {
+	return "tls://" + s.addr
+}
+
+func (s *tlsServer) exchange(ctx context.Context, _ string, query []byte) ([]byte, error) {
+	rawConn, err := bootstrapDial(ctx, s.dial, s.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, &tls.Config{ServerName: s.serverName})
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	return exchangeStream(conn, query)
+}
+
+// httpsServer speaks DNS-over-HTTPS (RFC 8484) with POST requests.
+type httpsServer struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSServer(serverURL *url.URL, dial DialFunc) *httpsServer {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return bootstrapDial(ctx, dial, addr)
+		},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	return &httpsServer{
+		url:    serverURL.String(),
+		client: &http.Client{Transport: transport, Timeout: exchangeTimeout},
+	}
+}
+
+func (s *httpsServer) String() string {
+	return s.url
+}
+
+func (s *httpsServer) exchange(ctx context.Context, _ string, query []byte) ([]byte, error) {
+	// The ID is zero on the wire so that HTTP caches can share answers.
+	id := []byte{query[0], query[1]}
+	body := append([]byte{0, 0}, query[2:]...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 2 {
+		return nil, fmt.Errorf("short DNS response")
+	}
+	response[0], response[1] = id[0], id[1]
+	return response, nil
+}
+
+// bootstrapDial resolves the hostname of a server with the system resolver,
+// never through goProxy's own, and connects to its addresses in turn.
+func bootstrapDial(ctx context.Context, dial DialFunc, addr string) (net.Conn, error) {
+	if dial == nil {
+		dialer := &net.Dialer{Timeout: exchangeTimeout}
+		dial = dialer.DialContext
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dial(ctx, "tcp", addr)
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dial(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, lastErr
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(exchangeTimeout)
+	}
+	conn.SetDeadline(deadline)
+}
+
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	if err := WriteMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return ReadMessage(conn)
+}
+
+// ReadMessage reads a message with the two-byte length prefix used over
+// stream transports.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, fmt.Errorf("error reading DNS message: %w", err)
+	}
+	return message, nil
+}
+
+// WriteMessage writes a message with the two-byte length prefix used over
+// stream transports.
+func WriteMessage(w io.Writer, message []byte) error {
+	buf := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(buf, uint16(len(message)))
+	_, err := w.Write(append(buf, message...))
+	return err
+}
@@ -0,0 +1,158 @@
+package resolver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"1.1.1.1", "1.1.1.1:53"},
+		{"udp://[2606:4700::1111]", "[2606:4700::1111]:53"},
+		{"tcp://9.9.9.9:5353", "tcp://9.9.9.9:5353"},
+		{"tls://dns.example", "tls://dns.example:853"},
+		{"https://dns.example/dns-query", "https://dns.example/dns-query"},
+		{SystemServer, SystemServer},
+	}
+	for _, tt := range tests {
+		s, err := parseServer(tt.address, nil)
+		if err != nil {
+			t.Errorf("parseServer(%q) = %v", tt.address, err)
+			continue
+		}
+		if s.String() != tt.want {
+			t.Errorf("parseServer(%q) = %s, want %s", tt.address, s, tt.want)
+		}
+	}
+
+	for _, address := range []string{"ftp://dns.example", "tcp://", "udp://%zz"} {
+		if _, err := parseServer(address, nil); err == nil {
+			t.Errorf("parseServer(%q) succeeded", address)
+		}
+	}
+}
+
+func TestServersForOverrides(t *testing.T) {
+	r, err := New([]string{"192.0.2.1"}, map[string]string{
+		"*.corp":     "192.0.2.2",
+		"*.lab.corp": "192.0.2.3",
+		"printer":    "192.0.2.4",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"example.com":    "192.0.2.1:53",
+		"corp":           "192.0.2.2:53",
+		"WWW.Corp.":      "192.0.2.2:53",
+		"host.lab.corp":  "192.0.2.3:53",
+		"printer":        "192.0.2.4:53",
+		"printer.corp":   "192.0.2.2:53",
+		"office.printer": "192.0.2.1:53",
+		"notcorp":        "192.0.2.1:53",
+	}
+	for name, want := range tests {
+		servers := r.serversFor(name)
+		if len(servers) != 1 || servers[0].String() != want {
+			t.Errorf("serversFor(%q) = %v, want %s", name, servers, want)
+		}
+	}
+}
+
+func TestExchangeTriesServersInOrder(t *testing.T) {
+	working := serveDNS(t, func(question dnsmessage.Question) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}}}
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	r, err := New([]string{dead, working}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, _, err := r.LookupIP(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) == 0 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("got %v from the second server", ips)
+	}
+}
+
+func TestHTTPSServer(t *testing.T) {
+	wireIDs := make(chan uint16, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var request dnsmessage.Message
+		if err := request.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wireIDs <- request.ID
+
+		question := request.Questions[0]
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: request.ID, Response: true},
+			Questions: request.Questions,
+		}
+		if question.Type == dnsmessage.TypeA {
+			response.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 9}},
+			}}
+		}
+		packed, _ := response.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	r, err := New([]string{server.URL + "/dns-query"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trust the test certificate.
+	doh := r.servers[0].(*httpsServer)
+	doh.client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	query, _ := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 4242, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	response, err := r.Exchange(context.Background(), "udp", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		t.Fatal(err)
+	}
+	if wireID := <-wireIDs; message.ID != 4242 || wireID != 0 {
+		t.Errorf("response ID %d, ID on the wire %d, want 4242 and 0", message.ID, wireID)
+	}
+	if len(message.Answers) != 1 {
+		t.Errorf("got %d answers, want 1", len(message.Answers))
+	}
+}